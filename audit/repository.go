@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const AUDIT_EVENTS_TABLE_NAME = "audit_events"
+
+// Who caused an event.
+const (
+	ACTOR_USER            = "user"
+	ACTOR_SERVICE_ACCOUNT = "service_account"
+	ACTOR_ANONYMOUS       = "anonymous"
+)
+
+type Event struct {
+	Id        int64     `json:"id"`
+	OrgId     int64     `json:"org_id,omitempty"`
+	ActorType string    `json:"actor_type"`
+	ActorId   int64     `json:"actor_id,omitempty"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Recorder interface {
+	Record(ctx context.Context, event Event) error
+}
+
+type Repository interface {
+	Recorder
+	ByActor(ctx context.Context, actorType string, actorId int64) ([]Event, error)
+	// ByTarget returns the events done to the target, like the lockouts of
+	// an account, whoever did them.
+	ByTarget(ctx context.Context, target string) ([]Event, error)
+	// ByOrg returns the latest events of the organization older than the
+	// event before, every one when before is 0, at most limit of them.
+	ByOrg(ctx context.Context, orgId int64, before int64, limit int) ([]Event, error)
+}
+
+type repo struct {
+	dbConnection *sql.DB
+}
+
+func NewRepo(dbConnection *sql.DB) Repository {
+	return repo{dbConnection}
+}
+
+func (r repo) Record(ctx context.Context, event Event) error {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (org_id, actor_type, actor_id, action, target, ip) VALUES ($1, $2, $3, $4, $5, $6);",
+		AUDIT_EVENTS_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(
+		ctx,
+		query,
+		nullIfZero(event.OrgId),
+		event.ActorType,
+		nullIfZero(event.ActorId),
+		event.Action,
+		event.Target,
+		event.IP,
+	)
+
+	return err
+}
+
+func (r repo) ByActor(ctx context.Context, actorType string, actorId int64) ([]Event, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, actor_type, actor_id, action, target, ip, created_at FROM %s "+
+			"WHERE actor_type=$1 AND actor_id=$2 ORDER BY id DESC;",
+		AUDIT_EVENTS_TABLE_NAME,
+	)
+	return r.query(ctx, query, actorType, actorId)
+}
+
+func (r repo) ByTarget(ctx context.Context, target string) ([]Event, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, actor_type, actor_id, action, target, ip, created_at FROM %s "+
+			"WHERE target=$1 ORDER BY id DESC;",
+		AUDIT_EVENTS_TABLE_NAME,
+	)
+	return r.query(ctx, query, target)
+}
+
+func (r repo) ByOrg(ctx context.Context, orgId int64, before int64, limit int) ([]Event, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, actor_type, actor_id, action, target, ip, created_at FROM %s "+
+			"WHERE org_id=$1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3;",
+		AUDIT_EVENTS_TABLE_NAME,
+	)
+	return r.query(ctx, query, orgId, before, limit)
+}
+
+func (r repo) query(ctx context.Context, query string, args ...any) ([]Event, error) {
+	rows, err := r.dbConnection.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var orgId, actorId sql.NullInt64
+		err := rows.Scan(
+			&event.Id,
+			&orgId,
+			&event.ActorType,
+			&actorId,
+			&event.Action,
+			&event.Target,
+			&event.IP,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.OrgId = orgId.Int64
+		event.ActorId = actorId.Int64
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func nullIfZero(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
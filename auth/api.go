@@ -2,19 +2,18 @@ package auth
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"myfeaturetoggles.com/toggles/logging"
 	"myfeaturetoggles.com/toggles/util"
-
-	bcrypt "golang.org/x/crypto/bcrypt"
 )
 
 const EXPIRATION_TIME_SECONDS int64 = 2 * 60 * 60 // 2 hs
 
-var ctx = context.Background()
-
 type signUpBody struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -23,6 +22,8 @@ type signUpBody struct {
 type authBody struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Code is the TOTP or recovery code, needed when 2FA is enabled.
+	Code string `json:"code"`
 }
 
 type AuthResponse struct {
@@ -30,20 +31,41 @@ type AuthResponse struct {
 }
 
 type signUpHandler struct {
-	repo UserRepository
+	repo      UserRepository
+	passwords *Passwords
+	mailer    *AccountMailer
+	logger    *logging.Logger
 }
 
 type authHandler struct {
-	repo   UserRepository
-	logger *log.Logger
+	repo      UserRepository
+	passwords *Passwords
+	twoFactor TwoFactorRepository
+	throttle  *LoginThrottle
+	sessions  *Sessions
+	logger    *logging.Logger
 }
 
-func NewSignUpHandler(ctx context.Context, logger *log.Logger, repo UserRepository) http.Handler {
-	return signUpHandler{repo}
+func NewSignUpHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo UserRepository,
+	passwords *Passwords,
+	mailer *AccountMailer,
+) http.Handler {
+	return signUpHandler{repo, passwords, mailer, logger}
 }
 
-func NewAuthUpHandler(ctx context.Context, logger *log.Logger, repo UserRepository) http.Handler {
-	return authHandler{repo, logger}
+func NewAuthUpHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo UserRepository,
+	passwords *Passwords,
+	twoFactor TwoFactorRepository,
+	throttle *LoginThrottle,
+	sessions *Sessions,
+) http.Handler {
+	return authHandler{repo, passwords, twoFactor, throttle, sessions, logger}
 }
 
 func (h signUpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -61,17 +83,32 @@ func (h signUpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	hash, err := hashPass(body.Password)
+	if err := h.passwords.Check(body.Password); err != nil {
+		util.JsonError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+
+	hash, err := h.passwords.Hash(body.Password)
 	if err != nil {
 		util.ErrorResponse(err, w)
+		return
 	}
 
-	err = h.repo.Create(ctx, body.Email, hash)
+	err = h.repo.Create(req.Context(), body.Email, hash)
 	if err != nil {
 		util.ErrorResponse(err, w)
 		return
 	}
 
+	// the account exists already, if the mail fails it can be sent again
+	user, err := h.repo.Get(req.Context(), body.Email)
+	if err == nil {
+		err = h.mailer.SendVerification(req.Context(), user)
+	}
+	if err != nil {
+		util.RequestLogger(h.logger, req).Error("error sending verification mail", "error", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -86,42 +123,107 @@ func (h authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	json.NewDecoder(req.Body).Decode(&userRequest)
 	if userRequest.Email == "" || userRequest.Password == "" {
 		util.JsonError("Both email and password are required", http.StatusBadRequest, w)
+		return
 	}
 
-	user, err := h.repo.Get(ctx, userRequest.Email)
-	if err != nil {
+	ip := clientIP(req)
+	if lockedOut(h.throttle, userRequest.Email, ip, w) {
+		return
+	}
+
+	user, err := h.repo.Get(req.Context(), userRequest.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		util.ErrorResponse(err, w)
 		return
 	}
-	isValid := validatePass(userRequest.Password, user.PasswordHash)
-	if !isValid {
-		util.JsonError("Invalid password", 401, w)
+	passwordHash := user.PasswordHash
+	if err != nil {
+		passwordHash = h.passwords.dummyHash()
+	}
+	if !validatePass(userRequest.Password, passwordHash) || err != nil {
+		loginFailure(h.throttle, h.logger, req, userRequest.Email, ip, w)
+		return
+	}
+	if !user.EmailVerified {
+		util.JsonError("Email not verified", http.StatusForbidden, w)
 		return
 	}
-	h.logger.Printf("user email: %s, user pass: %s", user.Email, user.PasswordHash)
 
-	token := generateJWT(user)
+	tf, err := h.twoFactor.Get(req.Context(), user.Id)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if tf.Enabled {
+		if userRequest.Code == "" {
+			util.JsonError("Two-factor code required", http.StatusUnauthorized, w)
+			return
+		}
+		valid, err := verifySecondFactor(req.Context(), h.twoFactor, user.Id, tf.Secret, userRequest.Code)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !valid {
+			loginFailure(h.throttle, h.logger, req, userRequest.Email, ip, w)
+			return
+		}
+	}
+	h.throttle.Success(userRequest.Email)
+	h.rehash(req, user, userRequest.Password)
+	util.RequestLogger(h.logger, req).Info("user logged in", "user_id", user.Id)
+
+	token, err := h.sessions.Start(req.Context(), user, req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
 	util.JsonResponse(AuthResponse{token}, http.StatusOK, w)
 }
 
-type jwtHeader struct {
-	Algorithm string
+// rehash updates hashes made with an outdated cost, now that the password is known.
+func (h authHandler) rehash(req *http.Request, user User, password string) {
+	if !h.passwords.NeedsRehash(user.PasswordHash) {
+		return
+	}
+	hash, err := h.passwords.Hash(password)
+	if err == nil {
+		err = h.repo.UpdatePassword(req.Context(), user.Id, hash)
+	}
+	if err != nil {
+		util.RequestLogger(h.logger, req).Error("error rehashing password", "error", err)
+	}
 }
 
-type jwtPayload struct {
-	UserId int64
-	Iat    int64
+// lockedOut responds 429 when the account or the IP can't attempt to log in
+// for now.
+func lockedOut(throttle *LoginThrottle, email string, ip string, w http.ResponseWriter) bool {
+	wait := throttle.LockedFor(email, ip)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	util.JsonError("Too many failed attempts, try again later", http.StatusTooManyRequests, w)
+	return true
 }
 
-func hashPass(password string) (string, error) {
-	r, e := bcrypt.GenerateFromPassword([]byte(password), 0)
-	if e != nil {
-		return "", e
+// loginFailure answers every failed login the same way, so it can't be used
+// to find out which emails have an account.
+func loginFailure(throttle *LoginThrottle, logger *logging.Logger, req *http.Request, email string, ip string, w http.ResponseWriter) {
+	if err := throttle.Failure(req.Context(), email, ip); err != nil {
+		util.RequestLogger(logger, req).Error("error recording lockout", "error", err)
 	}
-	return string(r), nil
+	util.JsonError("Invalid credentials", http.StatusUnauthorized, w)
 }
 
-func validatePass(password string, passwordHash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
-	return err == nil
+type jwtHeader struct {
+	Algorithm string
+}
+
+type jwtPayload struct {
+	UserId int64
+	Iat    int64
+	Jti    string
+	Gen    int64
+	Admin  bool
 }
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"log"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
 )
 
 const fakeJwt = "header.eyJVc2VySWQiOjEwLCJJYXQiOjE2NjI4NTQ2NzB9.sign"
@@ -24,11 +26,43 @@ func (fr fakeRepo) Get(ctx context.Context, email string) (User, error) {
 	return fr.User, nil
 }
 
+func (fr fakeRepo) GetById(ctx context.Context, id int64) (User, error) {
+	return fr.User, nil
+}
+
+func (fr fakeRepo) MarkVerified(ctx context.Context, userId int64) error {
+	return nil
+}
+
+func (fr fakeRepo) UpdatePassword(ctx context.Context, userId int64, passwordHash string) error {
+	return nil
+}
+
+func (fr fakeRepo) UpdateDisplayName(ctx context.Context, userId int64, displayName string) error {
+	return nil
+}
+
+func (fr fakeRepo) SetPendingEmail(ctx context.Context, userId int64, email string) error {
+	return nil
+}
+
+func (fr fakeRepo) ConfirmEmail(ctx context.Context, userId int64, email string) error {
+	return nil
+}
+
+func (fr fakeRepo) Delete(ctx context.Context, userId int64) error {
+	return nil
+}
+
+func newTestAccountMailer() *AccountMailer {
+	return NewAccountMailer(fakeTokenRepo{}, fakeMailer{&[]mail.Message{}}, "http://test")
+}
+
 func TestSignUp(t *testing.T) {
 
 	body, _ := json.Marshal(signUpBody{"ibado", "pass1234"})
 
-	handler := NewSignUpHandler(context.Background(), log.Default(), fakeRepo{})
+	handler := NewSignUpHandler(context.Background(), logging.Default(), fakeRepo{}, testPasswords, newTestAccountMailer())
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest("POST", "/signup", bytes.NewReader(body))
 	request.Header.Add("Authorization", fakeJwt)
@@ -46,7 +80,7 @@ func TestSignUpFail(t *testing.T) {
 
 	body, _ := json.Marshal(signUpBody{"", "pass1234"})
 
-	handler := NewSignUpHandler(context.Background(), log.Default(), fakeRepo{})
+	handler := NewSignUpHandler(context.Background(), logging.Default(), fakeRepo{}, testPasswords, newTestAccountMailer())
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest("POST", "/signup", bytes.NewReader(body))
 	request.Header.Add("Authorization", fakeJwt)
@@ -73,10 +107,10 @@ func validJWT(jwt string) bool {
 
 func TestAuth(t *testing.T) {
 	ab := authBody{Email: "test@test.com", Password: "asd123456"}
-	passwordHash, err := hashPass(ab.Password)
-	user := User{10, "test@test.com", passwordHash}
+	passwordHash, err := testPasswords.Hash(ab.Password)
+	user := User{Id: 10, Email: "test@test.com", PasswordHash: passwordHash, EmailVerified: true}
 	repo := fakeRepo{user}
-	authHandler := NewAuthUpHandler(context.Background(), log.Default(), repo)
+	authHandler := NewAuthUpHandler(context.Background(), logging.Default(), repo, testPasswords, newFakeTwoFactorRepo(), newTestThrottle(), newTestSessions(t))
 	recorder := httptest.NewRecorder()
 	body, err := json.Marshal(ab)
 	if err != nil {
@@ -104,9 +138,9 @@ func TestAuth(t *testing.T) {
 
 func TestAuthInvalidPass(t *testing.T) {
 	ab := authBody{Email: "test@test.com", Password: "invalid password"}
-	user := User{10, "test@test.com", "hash that doesn't match"}
+	user := User{Id: 10, Email: "test@test.com", PasswordHash: "hash that doesn't match"}
 	repo := fakeRepo{user}
-	authHandler := NewAuthUpHandler(context.Background(), log.Default(), repo)
+	authHandler := NewAuthUpHandler(context.Background(), logging.Default(), repo, testPasswords, newFakeTwoFactorRepo(), newTestThrottle(), newTestSessions(t))
 	recorder := httptest.NewRecorder()
 	body, err := json.Marshal(ab)
 	if err != nil {
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const API_KEYS_TABLE_NAME = "api_keys"
+
+// Server keys get the same access as the owning account, client keys are
+// meant to be embedded in apps and can only read toggles.
+const (
+	SERVER_KEY = "server"
+	CLIENT_KEY = "client"
+)
+
+var keyPrefixes = map[string]string{
+	SERVER_KEY: "srv_",
+	CLIENT_KEY: "cli_",
+}
+
+type APIKey struct {
+	Id        int64     `json:"id"`
+	UserId    int64     `json:"user_id"`
+	OrgId     int64     `json:"-"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Prefix    string    `json:"prefix"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	// ServiceAccount tells if UserId is a service account.
+	ServiceAccount bool `json:"service_account"`
+	// Environment restricts the key to the toggles of one environment, keys
+	// without one can use every environment.
+	Environment string `json:"environment,omitempty"`
+}
+
+type APIKeyRepository interface {
+	Create(ctx context.Context, key APIKey, hash string) (int64, error)
+	GetAll(ctx context.Context, orgId int64) ([]APIKey, error)
+	// ByUser returns the keys the user created in every organization.
+	ByUser(ctx context.Context, userId int64) ([]APIKey, error)
+	GetByHash(ctx context.Context, hash string) (APIKey, error)
+	Revoke(ctx context.Context, id int64, orgId int64) (bool, error)
+}
+
+type apiKeyRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewAPIKeyRepo(dbConnection *sql.DB) APIKeyRepository {
+	return apiKeyRepo{dbConnection}
+}
+
+func (r apiKeyRepo) Create(ctx context.Context, key APIKey, hash string) (int64, error) {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (user_id, org_id, name, key_type, prefix, scopes, environment, key_hash) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;",
+		API_KEYS_TABLE_NAME,
+	)
+	var id int64
+	err := r.dbConnection.
+		QueryRowContext(
+			ctx,
+			query,
+			key.UserId,
+			key.OrgId,
+			key.Name,
+			key.Type,
+			key.Prefix,
+			formatScopes(key.Scopes),
+			key.Environment,
+			hash,
+		).
+		Scan(&id)
+
+	return id, err
+}
+
+func (r apiKeyRepo) GetAll(ctx context.Context, orgId int64) ([]APIKey, error) {
+	query := fmt.Sprintf(
+		"SELECT k.id, k.user_id, k.org_id, k.name, k.key_type, k.prefix, k.scopes, k.created_at, u.service_org_id IS NOT NULL, k.environment "+
+			"FROM %s k JOIN %s u ON u.id = k.user_id WHERE k.org_id=$1 ORDER BY k.id;",
+		API_KEYS_TABLE_NAME,
+		USERS_TABLE_NAME,
+	)
+	return r.query(ctx, query, orgId)
+}
+
+func (r apiKeyRepo) ByUser(ctx context.Context, userId int64) ([]APIKey, error) {
+	query := fmt.Sprintf(
+		"SELECT k.id, k.user_id, k.org_id, k.name, k.key_type, k.prefix, k.scopes, k.created_at, u.service_org_id IS NOT NULL, k.environment "+
+			"FROM %s k JOIN %s u ON u.id = k.user_id WHERE k.user_id=$1 ORDER BY k.id;",
+		API_KEYS_TABLE_NAME,
+		USERS_TABLE_NAME,
+	)
+	return r.query(ctx, query, userId)
+}
+
+func (r apiKeyRepo) query(ctx context.Context, query string, args ...any) ([]APIKey, error) {
+	rows, err := r.dbConnection.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r apiKeyRepo) GetByHash(ctx context.Context, hash string) (APIKey, error) {
+	query := fmt.Sprintf(
+		"SELECT k.id, k.user_id, k.org_id, k.name, k.key_type, k.prefix, k.scopes, k.created_at, u.service_org_id IS NOT NULL, k.environment "+
+			"FROM %s k JOIN %s u ON u.id = k.user_id WHERE k.key_hash=$1;",
+		API_KEYS_TABLE_NAME,
+		USERS_TABLE_NAME,
+	)
+	return scanAPIKey(r.dbConnection.QueryRowContext(ctx, query, hash))
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	err := row.Scan(
+		&key.Id,
+		&key.UserId,
+		&key.OrgId,
+		&key.Name,
+		&key.Type,
+		&key.Prefix,
+		&scopes,
+		&key.CreatedAt,
+		&key.ServiceAccount,
+		&key.Environment,
+	)
+	key.Scopes = parseScopes(scopes)
+	if len(key.Scopes) == 0 {
+		key.Scopes = defaultKeyScopes[key.Type]
+	}
+
+	return key, err
+}
+
+func (r apiKeyRepo) Revoke(ctx context.Context, id int64, orgId int64) (bool, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id=$1 AND org_id=$2;", API_KEYS_TABLE_NAME)
+	res, err := r.dbConnection.ExecContext(ctx, query, id, orgId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
+
+// generateAPIKey returns the plain key, which is only shown once, and the
+// hash that gets stored.
+func generateAPIKey(keyType string) (string, string) {
+	b := make([]byte, 24)
+	rand.Read(b)
+	key := keyPrefixes[keyType] + base64.RawURLEncoding.EncodeToString(b)
+
+	return key, hashToken(key)
+}
+
+// Tokens and API keys are long random strings, so a fast hash is enough to
+// keep them safe at rest and allows looking them up on every request.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random secret token and its hash.
+func newToken() (string, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	return token, hashToken(token)
+}
+
+func isAPIKey(token string) bool {
+	for _, prefix := range keyPrefixes {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type createAPIKeyBody struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Scopes      []string `json:"scopes"`
+	Environment string   `json:"environment"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyHandler struct {
+	repo   APIKeyRepository
+	logger *logging.Logger
+}
+
+func NewAPIKeyHandler(ctx context.Context, logger *logging.Logger, repo APIKeyRepository) http.Handler {
+	return apiKeyHandler{repo, logger}
+}
+
+func (h apiKeyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage API keys", http.StatusForbidden, w)
+		return
+	}
+	if !Authorize(w, req, ACTION_MANAGE_KEYS) {
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		keys, err := h.repo.GetAll(req.Context(), principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(keys, http.StatusOK, w)
+	case "POST":
+		createAPIKey(h.repo, principal, APIKey{UserId: principal.UserId, OrgId: principal.OrgId}, w, req)
+	case "DELETE":
+		id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/apikeys/"), 10, 64)
+		if err != nil {
+			util.JsonError("A valid id is required: /apikeys/<id>", http.StatusBadRequest, w)
+			return
+		}
+
+		found, err := h.repo.Revoke(req.Context(), id, principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+// createAPIKey completes the owner of the key with what the principal
+// requested, stores it and writes the response. It returns false when
+// nothing was created.
+func createAPIKey(
+	repo APIKeyRepository,
+	principal Principal,
+	key APIKey,
+	w http.ResponseWriter,
+	req *http.Request,
+) (APIKey, bool) {
+	defer req.Body.Close()
+	var body createAPIKeyBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || body.Name == "" {
+		util.JsonError("'name' is required", http.StatusBadRequest, w)
+		return APIKey{}, false
+	}
+	if _, ok := keyPrefixes[body.Type]; !ok {
+		util.JsonError("'type' must be either 'server' or 'client'", http.StatusBadRequest, w)
+		return APIKey{}, false
+	}
+
+	if len(body.Scopes) == 0 {
+		body.Scopes = defaultKeyScopes[body.Type]
+	}
+	if msg := validateKeyScopes(principal, body.Type, body.Scopes); msg != "" {
+		util.JsonError(msg, http.StatusBadRequest, w)
+		return APIKey{}, false
+	}
+	if !IsValidEnvironment(body.Environment) {
+		util.JsonError(fmt.Sprintf("'environment' must be up to %d lowercase letters, digits, '-' or '_'", MAX_ENVIRONMENT_LENGTH), http.StatusBadRequest, w)
+		return APIKey{}, false
+	}
+
+	plain, hash := generateAPIKey(body.Type)
+	key.Name = body.Name
+	key.Type = body.Type
+	key.Prefix = plain[:8]
+	key.Scopes = body.Scopes
+	key.Environment = body.Environment
+	key.Id, err = repo.Create(req.Context(), key, hash)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return APIKey{}, false
+	}
+
+	util.JsonResponse(CreateAPIKeyResponse{key, plain}, http.StatusCreated, w)
+	return key, true
+}
+
+// validateKeyScopes returns a message describing why the scopes can't be
+// granted, or an empty string if they can.
+func validateKeyScopes(creator Principal, keyType string, scopes []string) string {
+	for _, scope := range scopes {
+		if !containsScope(knownScopes, scope) {
+			return "Unknown scope: " + scope
+		}
+		if keyType == CLIENT_KEY && !containsScope(allowedClientScopes, scope) {
+			return "Client keys can't have scope: " + scope
+		}
+		if !creator.HasScope(scope) {
+			return "Can't grant a scope you don't have: " + scope
+		}
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeAPIKeyRepo struct {
+	keys map[string]APIKey
+}
+
+func (r fakeAPIKeyRepo) Create(ctx context.Context, key APIKey, hash string) (int64, error) {
+	key.Id = int64(len(r.keys) + 1)
+	r.keys[hash] = key
+	return key.Id, nil
+}
+
+func (r fakeAPIKeyRepo) GetAll(ctx context.Context, userId int64) ([]APIKey, error) {
+	keys := []APIKey{}
+	for _, k := range r.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (r fakeAPIKeyRepo) ByUser(ctx context.Context, userId int64) ([]APIKey, error) {
+	keys := []APIKey{}
+	for _, k := range r.keys {
+		if k.UserId == userId {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (r fakeAPIKeyRepo) GetByHash(ctx context.Context, hash string) (APIKey, error) {
+	key, ok := r.keys[hash]
+	if !ok {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (r fakeAPIKeyRepo) Revoke(ctx context.Context, id int64, userId int64) (bool, error) {
+	return false, nil
+}
+
+func serveWithAuth(t *testing.T, keys APIKeyRepository, method string, token string) (*http.Response, Principal) {
+	var principal Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = GetPrincipal(r)
+	})
+	scopes := RequireScopes(SCOPE_TOGGLES_READ, SCOPE_TOGGLES_WRITE)
+	handler := AuthMiddleware(newTestRevocationList(t), newTestSessions(t), keys, newTestOrgRepo())(scopes(next))
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "/toggles", nil)
+	request.Header.Add("Authorization", token)
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Result(), principal
+}
+
+func asOrgAdmin(request *http.Request) *http.Request {
+	principal := Principal{UserId: 10, OrgId: 1, Role: ROLE_ADMIN, Scopes: sessionScopes(false)}
+	return request.WithContext(WithPrincipal(request.Context(), principal))
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	repo := fakeAPIKeyRepo{map[string]APIKey{}}
+	handler := NewAPIKeyHandler(context.Background(), logging.Default(), repo)
+	recorder := httptest.NewRecorder()
+	request := asOrgAdmin(httptest.NewRequest("POST", "/apikeys", strings.NewReader(`{"name": "backend", "type": "server"}`)))
+
+	handler.ServeHTTP(recorder, request)
+
+	result := recorder.Result()
+	defer result.Body.Close()
+	if result.StatusCode != 201 {
+		t.Fatalf("Status code should be 201 but is %d", result.StatusCode)
+	}
+
+	var body CreateAPIKeyResponse
+	json.NewDecoder(result.Body).Decode(&body)
+	if !strings.HasPrefix(body.Key, "srv_") {
+		t.Fatalf("server keys should start with srv_ but got '%s'", body.Key)
+	}
+	stored, ok := repo.keys[hashToken(body.Key)]
+	if !ok || stored.UserId != 10 {
+		t.Fatal("key should be stored hashed for the user")
+	}
+}
+
+func TestAuthMiddlewareAcceptsAPIKeys(t *testing.T) {
+	repo := fakeAPIKeyRepo{map[string]APIKey{}}
+	server, serverHash := generateAPIKey(SERVER_KEY)
+	client, clientHash := generateAPIKey(CLIENT_KEY)
+	repo.keys[serverHash] = APIKey{Id: 1, UserId: 10, OrgId: 1, Type: SERVER_KEY, Scopes: defaultKeyScopes[SERVER_KEY]}
+	repo.keys[clientHash] = APIKey{Id: 2, UserId: 10, OrgId: 1, Type: CLIENT_KEY, Scopes: defaultKeyScopes[CLIENT_KEY]}
+
+	result, principal := serveWithAuth(t, repo, "PUT", server)
+	if result.StatusCode != 200 || principal.UserId != 10 || principal.KeyId != 1 {
+		t.Fatalf("server key should be allowed to write, got %d", result.StatusCode)
+	}
+
+	result, _ = serveWithAuth(t, repo, "GET", client)
+	if result.StatusCode != 200 {
+		t.Fatalf("client key should be allowed to read, got %d", result.StatusCode)
+	}
+
+	result, _ = serveWithAuth(t, repo, "PUT", client)
+	if result.StatusCode != 403 {
+		t.Fatalf("client key shouldn't be allowed to write, got %d", result.StatusCode)
+	}
+
+	unknown, _ := generateAPIKey(SERVER_KEY)
+	result, _ = serveWithAuth(t, repo, "GET", unknown)
+	if result.StatusCode != 401 {
+		t.Fatalf("unknown keys should be rejected, got %d", result.StatusCode)
+	}
+}
+
+func TestCreateAPIKeyScopes(t *testing.T) {
+	cases := []struct {
+		body       string
+		statusCode int
+	}{
+		{`{"name": "ci", "type": "server", "scopes": ["toggles:write"]}`, 201},
+		{`{"name": "ui", "type": "client", "scopes": ["toggles:write"]}`, 400},
+		{`{"name": "ops", "type": "server", "scopes": ["admin"]}`, 400},
+		{`{"name": "typo", "type": "server", "scopes": ["toggles:wirte"]}`, 400},
+		{`{"name": "ci", "type": "server", "environment": "staging"}`, 201},
+		{`{"name": "ci", "type": "server", "environment": "Staging!"}`, 400},
+	}
+
+	for _, c := range cases {
+		handler := NewAPIKeyHandler(context.Background(), logging.Default(), fakeAPIKeyRepo{map[string]APIKey{}})
+		recorder := httptest.NewRecorder()
+		request := asOrgAdmin(httptest.NewRequest("POST", "/apikeys", strings.NewReader(c.body)))
+
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != c.statusCode {
+			t.Errorf("%s: status code should be %d but is %d", c.body, c.statusCode, recorder.Result().StatusCode)
+		}
+	}
+}
+
+func TestCreateAPIKeyNeedsAdmin(t *testing.T) {
+	handler := NewAPIKeyHandler(context.Background(), logging.Default(), fakeAPIKeyRepo{map[string]APIKey{}})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/apikeys", strings.NewReader(`{"name": "backend", "type": "server"}`))
+	principal := Principal{UserId: 10, OrgId: 1, Role: ROLE_EDITOR, Scopes: sessionScopes(false)}
+	request = request.WithContext(WithPrincipal(request.Context(), principal))
+
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != 403 {
+		t.Fatalf("Status code should be 403 but is %d", recorder.Result().StatusCode)
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const AUDIT_PAGE_SIZE = 100
+
+type auditHandler struct {
+	repo   audit.Repository
+	logger *logging.Logger
+}
+
+// NewAuditHandler serves GET /orgs/audit, the audit log of the organization,
+// newest first. ?before=<id> returns the page of events older than that one.
+// It has to be behind RequireScope(SCOPE_AUDIT_READ).
+func NewAuditHandler(ctx context.Context, logger *logging.Logger, repo audit.Repository) http.Handler {
+	return auditHandler{repo, logger}
+}
+
+func (h auditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+		return
+	}
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if !Authorize(w, req, ACTION_READ_AUDIT) {
+		return
+	}
+
+	var before int64
+	if param := req.URL.Query().Get("before"); param != "" {
+		before, err = strconv.ParseInt(param, 10, 64)
+		if err != nil || before <= 0 {
+			util.JsonError("'before' must be an event id", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	events, err := h.repo.ByOrg(req.Context(), principal.OrgId, before, AUDIT_PAGE_SIZE)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	util.JsonResponse(events, http.StatusOK, w)
+}
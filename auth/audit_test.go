@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeAuditRepo struct {
+	fakeRecorder
+}
+
+func (r fakeAuditRepo) ByActor(ctx context.Context, actorType string, actorId int64) ([]audit.Event, error) {
+	return []audit.Event{}, nil
+}
+
+func (r fakeAuditRepo) ByTarget(ctx context.Context, target string) ([]audit.Event, error) {
+	return []audit.Event{}, nil
+}
+
+func (r fakeAuditRepo) ByOrg(ctx context.Context, orgId int64, before int64, limit int) ([]audit.Event, error) {
+	events := []audit.Event{}
+	for i := len(*r.events) - 1; i >= 0 && len(events) < limit; i-- {
+		event := (*r.events)[i]
+		if event.OrgId == orgId && (before == 0 || event.Id < before) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func TestAuditLog(t *testing.T) {
+	events := &[]audit.Event{{Id: 1, OrgId: 1, Action: "toggle.create"}, {Id: 2, OrgId: 2}, {Id: 3, OrgId: 1, Action: "toggle.delete"}}
+	handler := RequireScope(SCOPE_AUDIT_READ)(NewAuditHandler(context.Background(), logging.Default(), fakeAuditRepo{fakeRecorder{events}}))
+	serve := func(principal Principal, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", path, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+		return recorder
+	}
+
+	recorder := serve(Principal{UserId: 10, OrgId: 1, Role: ROLE_ADMIN, Scopes: sessionScopes(false)}, "/orgs/audit?before=3")
+	var page []audit.Event
+	json.NewDecoder(recorder.Body).Decode(&page)
+	if recorder.Code != 200 || len(page) != 1 || page[0].Id != 1 {
+		t.Fatalf("admins should read the audit log of their organization, got %d %v", recorder.Code, page)
+	}
+
+	key := Principal{UserId: 10, OrgId: 1, Role: ROLE_ADMIN, KeyType: SERVER_KEY, Scopes: defaultKeyScopes[SERVER_KEY]}
+	if recorder := serve(key, "/orgs/audit"); recorder.Code != 403 {
+		t.Fatalf("keys without audit:read should be rejected, got %d", recorder.Code)
+	}
+	key.Scopes = []string{SCOPE_AUDIT_READ}
+	if recorder := serve(key, "/orgs/audit"); recorder.Code != 200 {
+		t.Fatalf("keys with audit:read should read the audit log, got %d", recorder.Code)
+	}
+	editor := Principal{UserId: 11, OrgId: 1, Role: ROLE_EDITOR, Scopes: sessionScopes(false)}
+	if recorder := serve(editor, "/orgs/audit"); recorder.Code != 403 {
+		t.Fatalf("editors shouldn't read the audit log, got %d", recorder.Code)
+	}
+}
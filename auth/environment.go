@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const ENVIRONMENT_RESTRICTIONS_TABLE_NAME = "environment_restrictions"
+
+const MAX_ENVIRONMENT_LENGTH = 20
+
+// EnvironmentRestriction reserves changing the toggles of an environment of
+// the organization to members with at least Role, e.g. only admins change
+// production. Environments without one only need ACTION_WRITE_TOGGLES.
+type EnvironmentRestriction struct {
+	Environment string `json:"environment"`
+	Role        string `json:"role"`
+}
+
+type EnvironmentRepository interface {
+	GetAll(ctx context.Context, orgId int64) ([]EnvironmentRestriction, error)
+	// RequiredRole returns an empty string when the environment isn't restricted.
+	RequiredRole(ctx context.Context, orgId int64, environment string) (string, error)
+	Restrict(ctx context.Context, orgId int64, environment string, role string) error
+	Unrestrict(ctx context.Context, orgId int64, environment string) (bool, error)
+}
+
+type environmentRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewEnvironmentRepo(dbConnection *sql.DB) EnvironmentRepository {
+	return environmentRepo{dbConnection}
+}
+
+func (r environmentRepo) GetAll(ctx context.Context, orgId int64) ([]EnvironmentRestriction, error) {
+	query := fmt.Sprintf("SELECT environment, role FROM %s WHERE org_id=$1 ORDER BY environment;", ENVIRONMENT_RESTRICTIONS_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	restrictions := []EnvironmentRestriction{}
+	for rows.Next() {
+		var restriction EnvironmentRestriction
+		if err := rows.Scan(&restriction.Environment, &restriction.Role); err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, restriction)
+	}
+
+	return restrictions, rows.Err()
+}
+
+func (r environmentRepo) RequiredRole(ctx context.Context, orgId int64, environment string) (string, error) {
+	query := fmt.Sprintf("SELECT role FROM %s WHERE org_id=$1 AND environment=$2;", ENVIRONMENT_RESTRICTIONS_TABLE_NAME)
+	var role string
+	err := r.dbConnection.QueryRowContext(ctx, query, orgId, environment).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return role, err
+}
+
+func (r environmentRepo) Restrict(ctx context.Context, orgId int64, environment string, role string) error {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (org_id, environment, role) VALUES ($1, $2, $3) ON CONFLICT (org_id, environment) DO UPDATE SET role=$3;",
+		ENVIRONMENT_RESTRICTIONS_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(ctx, query, orgId, environment, role)
+
+	return err
+}
+
+func (r environmentRepo) Unrestrict(ctx context.Context, orgId int64, environment string) (bool, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE org_id=$1 AND environment=$2;", ENVIRONMENT_RESTRICTIONS_TABLE_NAME)
+	result, err := r.dbConnection.ExecContext(ctx, query, orgId, environment)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+
+	return count > 0, err
+}
+
+// IsValidEnvironment accepts short names of lowercase letters, digits, dashes
+// and underscores. The empty environment is the default one.
+func IsValidEnvironment(environment string) bool {
+	if len(environment) > MAX_ENVIRONMENT_LENGTH {
+		return false
+	}
+	for _, c := range environment {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type environmentHandler struct {
+	repo     EnvironmentRepository
+	recorder audit.Recorder
+	logger   *logging.Logger
+}
+
+func NewEnvironmentHandler(ctx context.Context, logger *logging.Logger, repo EnvironmentRepository, recorder audit.Recorder) http.Handler {
+	return environmentHandler{repo, recorder, logger}
+}
+
+// environmentHandler manages who can change the toggles of each environment:
+// GET /orgs/environments lists the restrictions, PUT /orgs/environments/<name>
+// with a role restricts it and DELETE /orgs/environments/<name> lifts it.
+func (h environmentHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	environment := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/orgs/environments"), "/")
+	if environment == "" {
+		if req.Method != "GET" {
+			util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+			return
+		}
+		if !Authorize(w, req, ACTION_READ_MEMBERS) {
+			return
+		}
+		restrictions, err := h.repo.GetAll(req.Context(), principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(restrictions, http.StatusOK, w)
+		return
+	}
+
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage environments", http.StatusForbidden, w)
+		return
+	}
+	if !Authorize(w, req, ACTION_MANAGE_MEMBERS) {
+		return
+	}
+	if !IsValidEnvironment(environment) {
+		util.JsonError(fmt.Sprintf("A valid environment is required: /orgs/environments/<name>, up to %d lowercase letters, digits, '-' or '_'", MAX_ENVIRONMENT_LENGTH), http.StatusBadRequest, w)
+		return
+	}
+	// nobody loosens or tightens a restriction beyond their own role
+	current, err := h.repo.RequiredRole(req.Context(), principal.OrgId, environment)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if current != "" && !hasRole(principal.Role, current) {
+		util.JsonError(fmt.Sprintf("Only %s members and above can change %s", current, environment), http.StatusForbidden, w)
+		return
+	}
+	target := "environment:" + environment
+
+	switch req.Method {
+	case "PUT":
+		defer req.Body.Close()
+		var body setRoleBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if !checkAssignableRole(principal, body.Role, w) {
+			return
+		}
+		if err := h.repo.Restrict(req.Context(), principal.OrgId, environment, body.Role); err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		h.record(req, principal, "environment.restrict", target)
+		util.JsonResponse(EnvironmentRestriction{environment, body.Role}, http.StatusOK, w)
+	case "DELETE":
+		removed, err := h.repo.Unrestrict(req.Context(), principal.OrgId, environment)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.record(req, principal, "environment.unrestrict", target)
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+func (h environmentHandler) record(req *http.Request, principal Principal, action string, target string) {
+	if err := h.recorder.Record(req.Context(), AuditEvent(req, principal, action, target)); err != nil {
+		util.RequestLogger(h.logger, req).Error("error recording audit event", "error", err)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeEnvironmentRepo map[string]string
+
+func (r fakeEnvironmentRepo) GetAll(ctx context.Context, orgId int64) ([]EnvironmentRestriction, error) {
+	restrictions := []EnvironmentRestriction{}
+	for environment, role := range r {
+		restrictions = append(restrictions, EnvironmentRestriction{environment, role})
+	}
+	return restrictions, nil
+}
+
+func (r fakeEnvironmentRepo) RequiredRole(ctx context.Context, orgId int64, environment string) (string, error) {
+	return r[environment], nil
+}
+
+func (r fakeEnvironmentRepo) Restrict(ctx context.Context, orgId int64, environment string, role string) error {
+	r[environment] = role
+	return nil
+}
+
+func (r fakeEnvironmentRepo) Unrestrict(ctx context.Context, orgId int64, environment string) (bool, error) {
+	_, ok := r[environment]
+	delete(r, environment)
+	return ok, nil
+}
+
+func serveEnvironments(repo fakeEnvironmentRepo, role string, method string, path string, body string) *httptest.ResponseRecorder {
+	events := &[]audit.Event{}
+	handler := NewEnvironmentHandler(context.Background(), logging.Default(), repo, fakeRecorder{events})
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	principal := Principal{UserId: 10, OrgId: 1, Role: role, Scopes: sessionScopes(false)}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+	return recorder
+}
+
+func TestRestrictEnvironment(t *testing.T) {
+	repo := fakeEnvironmentRepo{}
+
+	recorder := serveEnvironments(repo, ROLE_ADMIN, "PUT", "/orgs/environments/production", `{"role": "admin"}`)
+	if recorder.Code != http.StatusOK || repo["production"] != ROLE_ADMIN {
+		t.Fatalf("admins should restrict environments, got %d", recorder.Code)
+	}
+
+	recorder = serveEnvironments(repo, ROLE_EDITOR, "DELETE", "/orgs/environments/production", "")
+	if recorder.Code != http.StatusForbidden || repo["production"] != ROLE_ADMIN {
+		t.Fatalf("editors shouldn't lift restrictions, got %d", recorder.Code)
+	}
+
+	recorder = serveEnvironments(repo, ROLE_VIEWER, "GET", "/orgs/environments", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"production"`) {
+		t.Fatalf("members should see restrictions, got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestRestrictionAboveOwnRole(t *testing.T) {
+	repo := fakeEnvironmentRepo{"production": ROLE_OWNER}
+
+	recorder := serveEnvironments(repo, ROLE_ADMIN, "PUT", "/orgs/environments/staging", `{"role": "owner"}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("restricting above your role should be forbidden, got %d", recorder.Code)
+	}
+	recorder = serveEnvironments(repo, ROLE_ADMIN, "DELETE", "/orgs/environments/production", "")
+	if recorder.Code != http.StatusForbidden || repo["production"] != ROLE_OWNER {
+		t.Fatalf("lifting a restriction above your role should be forbidden, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const INVITATIONS_TABLE_NAME = "invitations"
+
+const INVITATION_EXPIRATION = 7 * 24 * time.Hour
+
+type Invitation struct {
+	Id        int64     `json:"id"`
+	OrgId     int64     `json:"-"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy int64     `json:"invited_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type InvitationRepository interface {
+	Create(ctx context.Context, invitation Invitation, tokenHash string) (Invitation, error)
+	Pending(ctx context.Context, orgId int64) ([]Invitation, error)
+	GetPending(ctx context.Context, tokenHash string) (Invitation, error)
+	Accept(ctx context.Context, tokenHash string, userId int64) error
+	Remove(ctx context.Context, id int64, orgId int64) (bool, error)
+	// ByUser returns the invitations the user sent or got at the email,
+	// accepted and expired ones included.
+	ByUser(ctx context.Context, userId int64, email string) ([]Invitation, error)
+}
+
+type invitationRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewInvitationRepo(dbConnection *sql.DB) InvitationRepository {
+	return invitationRepo{dbConnection}
+}
+
+// Create stores the invitation, which expires INVITATION_EXPIRATION from now.
+func (r invitationRepo) Create(ctx context.Context, invitation Invitation, tokenHash string) (Invitation, error) {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (org_id, email, role, invited_by, token_hash, expires_at) "+
+			"VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 second') RETURNING id, expires_at;",
+		INVITATIONS_TABLE_NAME,
+	)
+	err := r.dbConnection.QueryRowContext(
+		ctx,
+		query,
+		invitation.OrgId,
+		invitation.Email,
+		invitation.Role,
+		invitation.InvitedBy,
+		tokenHash,
+		INVITATION_EXPIRATION.Seconds(),
+	).Scan(&invitation.Id, &invitation.ExpiresAt)
+
+	return invitation, err
+}
+
+func (r invitationRepo) Pending(ctx context.Context, orgId int64) ([]Invitation, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, email, role, invited_by, expires_at FROM %s "+
+			"WHERE org_id=$1 AND accepted_at IS NULL AND expires_at > now() ORDER BY id;",
+		INVITATIONS_TABLE_NAME,
+	)
+	return r.query(ctx, query, orgId)
+}
+
+func (r invitationRepo) ByUser(ctx context.Context, userId int64, email string) ([]Invitation, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, email, role, invited_by, expires_at FROM %s WHERE invited_by=$1 OR email=$2 ORDER BY id;",
+		INVITATIONS_TABLE_NAME,
+	)
+	return r.query(ctx, query, userId, email)
+}
+
+func (r invitationRepo) query(ctx context.Context, query string, args ...any) ([]Invitation, error) {
+	rows, err := r.dbConnection.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// GetPending returns sql.ErrNoRows when the invitation doesn't exist, was
+// already accepted or expired.
+func (r invitationRepo) GetPending(ctx context.Context, tokenHash string) (Invitation, error) {
+	query := fmt.Sprintf(
+		"SELECT id, org_id, email, role, invited_by, expires_at FROM %s "+
+			"WHERE token_hash=$1 AND accepted_at IS NULL AND expires_at > now();",
+		INVITATIONS_TABLE_NAME,
+	)
+
+	return scanInvitation(r.dbConnection.QueryRowContext(ctx, query, tokenHash))
+}
+
+var errAlreadyMember = errors.New("already a member of the organization")
+
+// Accept marks the invitation as used and adds the user to the organization
+// in one transaction, so a token can only be used once. Members keep the role
+// they have, an invitation never changes it, they get errAlreadyMember and
+// the invitation stays pending.
+func (r invitationRepo) Accept(ctx context.Context, tokenHash string, userId int64) error {
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET accepted_at=now() WHERE token_hash=$1 AND accepted_at IS NULL AND expires_at > now() "+
+			"RETURNING org_id, role;",
+		INVITATIONS_TABLE_NAME,
+	)
+	var orgId int64
+	var role string
+	if err := tx.QueryRowContext(ctx, query, tokenHash).Scan(&orgId, &role); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(
+		"INSERT INTO %s (org_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (org_id, user_id) DO NOTHING;",
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	res, err := tx.ExecContext(ctx, query, orgId, userId, role)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		if err == nil {
+			err = errAlreadyMember
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r invitationRepo) Remove(ctx context.Context, id int64, orgId int64) (bool, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id=$1 AND org_id=$2 AND accepted_at IS NULL;", INVITATIONS_TABLE_NAME)
+	res, err := r.dbConnection.ExecContext(ctx, query, id, orgId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
+
+func scanInvitation(row scanner) (Invitation, error) {
+	var invitation Invitation
+	err := row.Scan(
+		&invitation.Id,
+		&invitation.OrgId,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.InvitedBy,
+		&invitation.ExpiresAt,
+	)
+
+	return invitation, err
+}
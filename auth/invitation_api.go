@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type createInvitationBody struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type acceptInvitationBody struct {
+	Password string `json:"password"`
+	// Code is the TOTP or recovery code of existing users with 2FA enabled.
+	Code string `json:"code"`
+}
+
+type invitationHandler struct {
+	repo    InvitationRepository
+	mailer  mail.Mailer
+	baseURL string
+	logger  *logging.Logger
+}
+
+type acceptInvitationHandler struct {
+	repo      InvitationRepository
+	userRepo  UserRepository
+	passwords *Passwords
+	twoFactor TwoFactorRepository
+	throttle  *LoginThrottle
+	sessions  *Sessions
+	logger    *logging.Logger
+}
+
+func NewInvitationHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo InvitationRepository,
+	mailer mail.Mailer,
+	baseURL string,
+) http.Handler {
+	return invitationHandler{repo, mailer, baseURL, logger}
+}
+
+func NewAcceptInvitationHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo InvitationRepository,
+	userRepo UserRepository,
+	passwords *Passwords,
+	twoFactor TwoFactorRepository,
+	throttle *LoginThrottle,
+	sessions *Sessions,
+) http.Handler {
+	return acceptInvitationHandler{repo, userRepo, passwords, twoFactor, throttle, sessions, logger}
+}
+
+func (h invitationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage organizations", http.StatusForbidden, w)
+		return
+	}
+	if !Authorize(w, req, ACTION_MANAGE_MEMBERS) {
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		invitations, err := h.repo.Pending(req.Context(), principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(invitations, http.StatusOK, w)
+	case "POST":
+		defer req.Body.Close()
+		var body createInvitationBody
+		err = json.NewDecoder(req.Body).Decode(&body)
+		if err != nil || body.Email == "" {
+			util.JsonError("'email' is required", http.StatusBadRequest, w)
+			return
+		}
+		if body.Role == "" {
+			body.Role = ROLE_VIEWER
+		}
+		if !checkAssignableRole(principal, body.Role, w) {
+			return
+		}
+
+		token, hash := newToken()
+		invitation := Invitation{
+			OrgId:     principal.OrgId,
+			Email:     body.Email,
+			Role:      body.Role,
+			InvitedBy: principal.UserId,
+		}
+		invitation, err = h.repo.Create(req.Context(), invitation, hash)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		err = h.mailer.Send(req.Context(), mail.Message{
+			To:      invitation.Email,
+			Subject: "You've been invited to My feature toggles",
+			Body: fmt.Sprintf(
+				"You've been invited to join an organization as %s.\n\n"+
+					"Accept the invitation before %s with:\n\nPOST %s/invitations/%s/accept",
+				invitation.Role,
+				invitation.ExpiresAt.Format("2006-01-02 15:04"),
+				h.baseURL,
+				token,
+			),
+		})
+		if err != nil {
+			h.repo.Remove(req.Context(), invitation.Id, principal.OrgId)
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		util.JsonResponse(invitation, http.StatusCreated, w)
+	case "DELETE":
+		id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/orgs/invitations/"), 10, 64)
+		if err != nil {
+			util.JsonError("A valid id is required: /orgs/invitations/<id>", http.StatusBadRequest, w)
+			return
+		}
+
+		found, err := h.repo.Remove(req.Context(), id, principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+// acceptInvitationHandler handles POST /invitations/<token>/accept. Users that
+// don't have an account yet get one with the invited email and the password
+// in the body, existing users confirm it's them like they sign in, with their
+// password and their second factor when 2FA is enabled.
+func (h acceptInvitationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/invitations/"), "/accept")
+	if token == "" || strings.Contains(token, "/") || !strings.HasSuffix(req.URL.Path, "/accept") {
+		util.JsonError("A valid token is required: /invitations/<token>/accept", http.StatusBadRequest, w)
+		return
+	}
+
+	defer req.Body.Close()
+	var body acceptInvitationBody
+	json.NewDecoder(req.Body).Decode(&body)
+	if body.Password == "" {
+		util.JsonError("'password' is required", http.StatusBadRequest, w)
+		return
+	}
+
+	hash := hashToken(token)
+	invitation, err := h.repo.GetPending(req.Context(), hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		util.JsonError("Invitation not found or expired", http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	user, err := h.userRepo.Get(req.Context(), invitation.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := h.passwords.Check(body.Password); err != nil {
+			util.JsonError(err.Error(), http.StatusBadRequest, w)
+			return
+		}
+		user, err = h.signUp(req.Context(), invitation.Email, body.Password)
+	} else if err == nil && !h.confirm(w, req, user, body) {
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	err = h.repo.Accept(req.Context(), hash, user.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		util.JsonError("Invitation not found or expired", http.StatusNotFound, w)
+		return
+	}
+	if errors.Is(err, errAlreadyMember) {
+		util.JsonError("Already a member of the organization", http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	jwt, err := h.sessions.Start(req.Context(), user, req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	util.JsonResponse(AuthResponse{jwt}, http.StatusOK, w)
+}
+
+// confirm checks the credentials of an existing user, responding when they
+// don't match. Failures count towards the lockout of logins.
+func (h acceptInvitationHandler) confirm(w http.ResponseWriter, req *http.Request, user User, body acceptInvitationBody) bool {
+	ip := clientIP(req)
+	if lockedOut(h.throttle, user.Email, ip, w) {
+		return false
+	}
+	if !validatePass(body.Password, user.PasswordHash) {
+		loginFailure(h.throttle, h.logger, req, user.Email, ip, w)
+		return false
+	}
+
+	tf, err := h.twoFactor.Get(req.Context(), user.Id)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if !tf.Enabled {
+		h.throttle.Success(user.Email)
+		return true
+	}
+	if body.Code == "" {
+		util.JsonError("Two-factor code required", http.StatusUnauthorized, w)
+		return false
+	}
+	valid, err := verifySecondFactor(req.Context(), h.twoFactor, user.Id, tf.Secret, body.Code)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if !valid {
+		loginFailure(h.throttle, h.logger, req, user.Email, ip, w)
+		return false
+	}
+	h.throttle.Success(user.Email)
+	return true
+}
+
+func (h acceptInvitationHandler) signUp(ctx context.Context, email string, password string) (User, error) {
+	passwordHash, err := h.passwords.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+	if err := h.userRepo.Create(ctx, email, passwordHash); err != nil {
+		return User{}, err
+	}
+	user, err := h.userRepo.Get(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+
+	// the invitation token was mailed, so the email is already verified
+	return user, h.userRepo.MarkVerified(ctx, user.Id)
+}
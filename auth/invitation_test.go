@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
+)
+
+type fakeMailer struct {
+	sent *[]mail.Message
+}
+
+func (m fakeMailer) Send(ctx context.Context, msg mail.Message) error {
+	*m.sent = append(*m.sent, msg)
+	return nil
+}
+
+// fakeUsers keeps users by email.
+type fakeUsers map[string]User
+
+func (u fakeUsers) Create(ctx context.Context, email string, passwordHash string) error {
+	u[email] = User{Id: int64(len(u) + 100), Email: email, PasswordHash: passwordHash}
+	return nil
+}
+
+func (u fakeUsers) Get(ctx context.Context, email string) (User, error) {
+	user, ok := u[email]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (u fakeUsers) GetById(ctx context.Context, id int64) (User, error) {
+	for _, user := range u {
+		if user.Id == id {
+			return user, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (u fakeUsers) MarkVerified(ctx context.Context, userId int64) error {
+	for email, user := range u {
+		if user.Id == userId {
+			user.EmailVerified = true
+			u[email] = user
+		}
+	}
+	return nil
+}
+
+func (u fakeUsers) UpdatePassword(ctx context.Context, userId int64, passwordHash string) error {
+	for email, user := range u {
+		if user.Id == userId {
+			user.PasswordHash = passwordHash
+			u[email] = user
+		}
+	}
+	return nil
+}
+
+func (u fakeUsers) UpdateDisplayName(ctx context.Context, userId int64, displayName string) error {
+	for email, user := range u {
+		if user.Id == userId {
+			user.DisplayName = displayName
+			u[email] = user
+		}
+	}
+	return nil
+}
+
+func (u fakeUsers) SetPendingEmail(ctx context.Context, userId int64, newEmail string) error {
+	for email, user := range u {
+		if user.Id == userId {
+			user.PendingEmail = newEmail
+			u[email] = user
+		}
+	}
+	return nil
+}
+
+func (u fakeUsers) ConfirmEmail(ctx context.Context, userId int64, newEmail string) error {
+	for email, user := range u {
+		if user.Id == userId && user.PendingEmail == newEmail {
+			delete(u, email)
+			user.Email = newEmail
+			user.PendingEmail = ""
+			user.EmailVerified = true
+			u[newEmail] = user
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (u fakeUsers) Delete(ctx context.Context, userId int64) error {
+	for email, user := range u {
+		if user.Id == userId {
+			delete(u, email)
+		}
+	}
+	return nil
+}
+
+type fakeInvitationRepo struct {
+	invitations map[string]Invitation
+	accepted    map[int64]int64
+}
+
+func (r fakeInvitationRepo) Create(ctx context.Context, invitation Invitation, tokenHash string) (Invitation, error) {
+	invitation.Id = int64(len(r.invitations) + 1)
+	invitation.ExpiresAt = time.Now().Add(INVITATION_EXPIRATION)
+	r.invitations[tokenHash] = invitation
+	return invitation, nil
+}
+
+func (r fakeInvitationRepo) Pending(ctx context.Context, orgId int64) ([]Invitation, error) {
+	return []Invitation{}, nil
+}
+
+func (r fakeInvitationRepo) GetPending(ctx context.Context, tokenHash string) (Invitation, error) {
+	invitation, ok := r.invitations[tokenHash]
+	if !ok {
+		return Invitation{}, sql.ErrNoRows
+	}
+	if _, used := r.accepted[invitation.Id]; used {
+		return Invitation{}, sql.ErrNoRows
+	}
+	return invitation, nil
+}
+
+func (r fakeInvitationRepo) Accept(ctx context.Context, tokenHash string, userId int64) error {
+	invitation, err := r.GetPending(ctx, tokenHash)
+	if err != nil {
+		return err
+	}
+	// every invitation of the fake is to the same organization
+	for _, member := range r.accepted {
+		if member == userId {
+			return errAlreadyMember
+		}
+	}
+	r.accepted[invitation.Id] = userId
+	return nil
+}
+
+func (r fakeInvitationRepo) Remove(ctx context.Context, id int64, orgId int64) (bool, error) {
+	return false, nil
+}
+
+func (r fakeInvitationRepo) ByUser(ctx context.Context, userId int64, email string) ([]Invitation, error) {
+	return []Invitation{}, nil
+}
+
+func inviteUser(t *testing.T, repo InvitationRepository, email string) string {
+	var sent []mail.Message
+	handler := NewInvitationHandler(context.Background(), logging.Default(), repo, fakeMailer{&sent}, "http://test")
+	recorder := httptest.NewRecorder()
+	request := asOrgAdmin(httptest.NewRequest("POST", "/orgs/invitations", strings.NewReader(`{"email": "`+email+`"}`)))
+
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != 201 {
+		t.Fatalf("Status code should be 201 but is %d", recorder.Result().StatusCode)
+	}
+	if len(sent) != 1 || sent[0].To != email {
+		t.Fatalf("an invitation mail should be sent to %s", email)
+	}
+	start := strings.Index(sent[0].Body, "/invitations/") + len("/invitations/")
+	end := strings.Index(sent[0].Body, "/accept")
+
+	return sent[0].Body[start:end]
+}
+
+func acceptInvitation(t *testing.T, repo InvitationRepository, users UserRepository, token string, password string) int {
+	return acceptInvitationWith(t, repo, users, newFakeTwoFactorRepo(), token, `{"password": "`+password+`"}`)
+}
+
+func acceptInvitationWith(t *testing.T, repo InvitationRepository, users UserRepository, twoFactor TwoFactorRepository, token string, body string) int {
+	return acceptInvitationThrottled(t, repo, users, twoFactor, newTestThrottle(), token, body)
+}
+
+func acceptInvitationThrottled(
+	t *testing.T,
+	repo InvitationRepository,
+	users UserRepository,
+	twoFactor TwoFactorRepository,
+	throttle *LoginThrottle,
+	token string,
+	body string,
+) int {
+	handler := NewAcceptInvitationHandler(context.Background(), logging.Default(), repo, users, testPasswords, twoFactor, throttle, newTestSessions(t))
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/invitations/"+token+"/accept", strings.NewReader(body))
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Result().StatusCode
+}
+
+func TestAcceptInvitationNewUser(t *testing.T) {
+	repo := fakeInvitationRepo{map[string]Invitation{}, map[int64]int64{}}
+	users := fakeUsers{}
+	token := inviteUser(t, repo, "new@test.com")
+
+	if statusCode := acceptInvitation(t, repo, users, token, "pass1234"); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	user, err := users.Get(context.Background(), "new@test.com")
+	if err != nil || !user.EmailVerified {
+		t.Fatal("a verified account should be created for the invited email")
+	}
+	if repo.accepted[1] != user.Id {
+		t.Fatal("the new user should join the organization")
+	}
+
+	if statusCode := acceptInvitation(t, repo, users, token, "pass1234"); statusCode != 404 {
+		t.Fatalf("invitations should be single use, got %d", statusCode)
+	}
+}
+
+func TestAcceptInvitationExistingUser(t *testing.T) {
+	repo := fakeInvitationRepo{map[string]Invitation{}, map[int64]int64{}}
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"old@test.com": User{Id: 20, Email: "old@test.com", PasswordHash: passwordHash}}
+	token := inviteUser(t, repo, "old@test.com")
+
+	if statusCode := acceptInvitation(t, repo, users, token, "wrong password"); statusCode != 401 {
+		t.Fatalf("Status code should be 401 but is %d", statusCode)
+	}
+	if statusCode := acceptInvitation(t, repo, users, token, "pass1234"); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	if repo.accepted[1] != 20 {
+		t.Fatal("the existing user should join the organization")
+	}
+}
+
+func TestAcceptInvitationKeepsMemberRole(t *testing.T) {
+	repo := fakeInvitationRepo{map[string]Invitation{}, map[int64]int64{}}
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"old@test.com": User{Id: 20, Email: "old@test.com", PasswordHash: passwordHash}}
+	first := inviteUser(t, repo, "old@test.com")
+	second := inviteUser(t, repo, "old@test.com")
+
+	if statusCode := acceptInvitation(t, repo, users, first, "pass1234"); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	if statusCode := acceptInvitation(t, repo, users, second, "pass1234"); statusCode != 409 {
+		t.Fatalf("members shouldn't accept another invitation, got %d", statusCode)
+	}
+	if _, accepted := repo.accepted[2]; accepted {
+		t.Fatal("the invitation should stay pending")
+	}
+}
+
+func TestAcceptInvitationWithTwoFactor(t *testing.T) {
+	repo := fakeInvitationRepo{map[string]Invitation{}, map[int64]int64{}}
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"old@test.com": User{Id: 20, Email: "old@test.com", PasswordHash: passwordHash}}
+	twoFactor := newFakeTwoFactorRepo()
+	twoFactor.SetSecret(context.Background(), 20, generateTOTPSecret())
+	twoFactor.Enable(context.Background(), 20, nil)
+	token := inviteUser(t, repo, "old@test.com")
+
+	if statusCode := acceptInvitationWith(t, repo, users, twoFactor, token, `{"password": "pass1234"}`); statusCode != 401 {
+		t.Fatalf("a code should be required, got %d", statusCode)
+	}
+	if statusCode := acceptInvitationWith(t, repo, users, twoFactor, token, `{"password": "pass1234", "code": "000000"}`); statusCode != 401 {
+		t.Fatalf("invalid codes should be rejected, got %d", statusCode)
+	}
+	if _, accepted := repo.accepted[1]; accepted {
+		t.Fatal("the invitation should stay pending")
+	}
+
+	code, _ := totpCode(twoFactor.tf.Secret, totpStep(time.Now()))
+	body := `{"password": "pass1234", "code": "` + code + `"}`
+	if statusCode := acceptInvitationWith(t, repo, users, twoFactor, token, body); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+}
+
+func TestAcceptInvitationIsThrottled(t *testing.T) {
+	repo := fakeInvitationRepo{map[string]Invitation{}, map[int64]int64{}}
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"old@test.com": User{Id: 20, Email: "old@test.com", PasswordHash: passwordHash}}
+	throttle := newTestThrottle()
+	token := inviteUser(t, repo, "old@test.com")
+
+	for i := 0; i < MAX_ACCOUNT_FAILURES; i++ {
+		body := `{"password": "wrong password"}`
+		if statusCode := acceptInvitationThrottled(t, repo, users, newFakeTwoFactorRepo(), throttle, token, body); statusCode != 401 {
+			t.Fatalf("Status code should be 401 but is %d", statusCode)
+		}
+	}
+	body := `{"password": "pass1234"}`
+	if statusCode := acceptInvitationThrottled(t, repo, users, newFakeTwoFactorRepo(), throttle, token, body); statusCode != 429 {
+		t.Fatalf("the account should be locked out, got %d", statusCode)
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -13,31 +14,30 @@ import (
 )
 
 func GetUserId(req *http.Request) (int64, error) {
-	jwt := req.Header.Get("Authorization")
-	if jwt == "" {
-		return -1, errors.New("No authorization header available")
-	}
-	split := strings.Split(jwt, ".")
-	if len(split) != 3 {
-		return -1, errors.New("Invalid JWT")
-	}
-	payload, err := base64.RawURLEncoding.DecodeString(split[1])
+	principal, err := GetPrincipal(req)
 	if err != nil {
 		return -1, err
 	}
 
-	var payloadJson jwtPayload
-	err = json.Unmarshal(payload, &payloadJson)
-	if err != nil {
-		return -1, err
-	}
-
-	return payloadJson.UserId, nil
+	return principal.UserId, nil
 }
 
 func generateJWT(user User) string {
+	return encodeJWT(newJWTPayload(user))
+}
+
+func newJWTPayload(user User) jwtPayload {
+	return jwtPayload{
+		UserId: user.Id,
+		Iat:    time.Now().Unix(),
+		Jti:    newJti(),
+		Gen:    user.TokenGeneration,
+		Admin:  user.Admin,
+	}
+}
+
+func encodeJWT(payload jwtPayload) string {
 	header := jwtHeader{"HS256"}
-	payload := jwtPayload{user.Id, time.Now().Unix()}
 
 	headerJson, _ := json.Marshal(header)
 	payloadJson, _ := json.Marshal(payload)
@@ -51,31 +51,41 @@ func generateJWT(user User) string {
 	return headerWithPayload + "." + signature
 }
 
+func newJti() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 func sign(target string) string {
 	hash := hmac.New(sha256.New, []byte(os.Getenv("PRIVATE_KEY")))
 	hash.Write([]byte(target))
 	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
 }
 
-func validateJWT(token string) bool {
+// parseJWT checks the signature and expiration of the token and returns its payload.
+func parseJWT(token string) (jwtPayload, error) {
 	split := strings.Split(token, ".")
 	if len(split) != 3 {
-		return false
+		return jwtPayload{}, errors.New("Invalid JWT")
 	}
 
 	headerAndPayload := split[0] + "." + split[1]
 	signature := split[2]
 
-	if sign(headerAndPayload) != signature {
-		return false
+	if !hmac.Equal([]byte(sign(headerAndPayload)), []byte(signature)) {
+		return jwtPayload{}, errors.New("Invalid JWT signature")
 	}
 
-	payload, _ := decodeJWTPayload(split[1])
+	payload, err := decodeJWTPayload(split[1])
+	if err != nil {
+		return jwtPayload{}, err
+	}
 	if payload.Iat+EXPIRATION_TIME_SECONDS < time.Now().Unix() {
-		return false
+		return jwtPayload{}, errors.New("Expired JWT")
 	}
 
-	return true
+	return payload, nil
 }
 
 func decodeJWTPayload(payload string) (jwtPayload, error) {
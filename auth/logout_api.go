@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type revokeSessionsBody struct {
+	UserId int64 `json:"user_id"`
+}
+
+type logoutHandler struct {
+	revocations *RevocationList
+	logger      *logging.Logger
+}
+
+type revokeSessionsHandler struct {
+	revocations *RevocationList
+	logger      *logging.Logger
+}
+
+func NewLogoutHandler(ctx context.Context, logger *logging.Logger, revocations *RevocationList) http.Handler {
+	return logoutHandler{revocations, logger}
+}
+
+func NewRevokeSessionsHandler(ctx context.Context, logger *logging.Logger, revocations *RevocationList) http.Handler {
+	return revokeSessionsHandler{revocations, logger}
+}
+
+func (h logoutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("Only sessions can be logged out", http.StatusBadRequest, w)
+		return
+	}
+	if principal.SessionId == "" {
+		util.JsonError("Token can't be revoked, sign in again", http.StatusBadRequest, w)
+		return
+	}
+
+	// the token expires at the latest a full lifetime from now, remembering
+	// the revocation that long covers it without trusting its claims
+	session := jwtPayload{UserId: principal.UserId, Jti: principal.SessionId, Iat: time.Now().Unix()}
+	err = h.revocations.Revoke(req.Context(), session)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h revokeSessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	defer req.Body.Close()
+	var body revokeSessionsBody
+	err = json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || body.UserId <= 0 {
+		util.JsonError("A valid 'user_id' is required", http.StatusBadRequest, w)
+		return
+	}
+
+	err = h.revocations.RevokeUser(req.Context(), body.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	util.RequestLogger(h.logger, req).Info("sessions revoked", "user_id", body.UserId, "admin_id", principal.UserId)
+
+	w.WriteHeader(http.StatusOK)
+}
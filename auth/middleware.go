@@ -1,22 +1,123 @@
 package auth
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"myfeaturetoggles.com/toggles/logging"
 	"myfeaturetoggles.com/toggles/router"
+	"myfeaturetoggles.com/toggles/util"
 )
 
-func AuthMiddleware() router.Middleware {
+func AuthMiddleware(
+	revocations *RevocationList,
+	sessions *Sessions,
+	keys APIKeyRepository,
+	orgs OrgRepository,
+) router.Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			token := r.Header.Get("Authorization")
-
-			if token == "" || !validateJWT(token) {
+			if token == "" {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			var principal Principal
+			if isAPIKey(token) {
+				key, err := keys.GetByHash(r.Context(), hashToken(token))
+				if errors.Is(err, sql.ErrNoRows) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					util.ErrorResponse(err, w)
+					return
+				}
+				// keys act with the current role of the member who created them
+				role, err := orgs.Role(r.Context(), key.OrgId, key.UserId)
+				if errors.Is(err, sql.ErrNoRows) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					util.ErrorResponse(err, w)
+					return
+				}
+				principal = Principal{
+					UserId:  key.UserId,
+					OrgId:   key.OrgId,
+					Role:    role,
+					KeyId:   key.Id,
+					KeyType: key.Type,
+					Scopes:  key.Scopes,
+
+					ServiceAccount: key.ServiceAccount,
+					Environment:    key.Environment,
+				}
+			} else {
+				payload, err := parseJWT(token)
+				if err != nil || revocations.IsRevoked(payload) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				principal = Principal{UserId: payload.UserId, Scopes: sessionScopes(payload.Admin), SessionId: payload.Jti}
+
+				orgId, role, err := resolveOrg(r, payload.UserId, orgs)
+				if errors.Is(err, errNotMember) {
+					util.JsonError("Not a member of the organization", http.StatusForbidden, w)
+					return
+				}
+				if err != nil {
+					util.ErrorResponse(err, w)
+					return
+				}
+				principal.OrgId = orgId
+				principal.Role = role
+
+				if err := sessions.Touch(r.Context(), payload, r); err != nil {
+					util.ErrorResponse(err, w)
+					return
+				}
+			}
+
+			logging.AddRequestFields(r.Context(), "user_id", principal.UserId)
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
 		})
 	}
 }
+
+var errNotMember = errors.New("not a member of the organization")
+
+// resolveOrg returns the organization the request acts on and the user's role in it.
+func resolveOrg(r *http.Request, userId int64, orgs OrgRepository) (int64, string, error) {
+	var orgId int64
+	var err error
+	if header := r.Header.Get(ORG_HEADER); header != "" {
+		orgId, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			return 0, "", errNotMember
+		}
+	} else {
+		orgId, err = orgs.DefaultOrg(r.Context(), userId)
+	}
+	if err != nil {
+		return 0, "", notMemberIfNoRows(err)
+	}
+
+	role, err := orgs.Role(r.Context(), orgId, userId)
+	if err != nil {
+		return 0, "", notMemberIfNoRows(err)
+	}
+
+	return orgId, role, nil
+}
+
+func notMemberIfNoRows(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotMember
+	}
+	return err
+}
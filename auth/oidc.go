@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OIDC_IDENTITIES_TABLE_NAME = "oidc_identities"
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+	// AllowSignUp creates a local user the first time someone logs in.
+	AllowSignUp bool
+}
+
+type OIDCClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      any    `json:"aud"`
+	Expiration    int64  `json:"exp"`
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// OIDCProvider talks to the identity provider found in the issuer's discovery document.
+type OIDCProvider struct {
+	config                OIDCConfig
+	client                *http.Client
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+	mu                    sync.RWMutex
+	keys                  map[string]*rsa.PublicKey
+}
+
+func NewOIDCProvider(ctx context.Context, config OIDCConfig, client *http.Client) (*OIDCProvider, error) {
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, client, discoveryURL, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %s doesn't match %s", discovery.Issuer, config.Issuer)
+	}
+
+	return &OIDCProvider{
+		config:                config,
+		client:                client,
+		authorizationEndpoint: discovery.AuthorizationEndpoint,
+		tokenEndpoint:         discovery.TokenEndpoint,
+		jwksURI:               discovery.JwksURI,
+		keys:                  map[string]*rsa.PublicKey{},
+	}, nil
+}
+
+// AuthURL is where users are sent to log in, using the S256 PKCE challenge
+// of the verifier.
+func (p *OIDCProvider) AuthURL(state string, verifier string, nonce string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientId)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", "openid email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	return p.authorizationEndpoint + "?" + params.Encode()
+}
+
+// Exchange trades the authorization code for the ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientId)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %d", res.StatusCode)
+	}
+
+	var token struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.IdToken == "" {
+		return "", errors.New("token response without id_token")
+	}
+
+	return token.IdToken, nil
+}
+
+// VerifyIDToken checks the RS256 signature against the provider's JWKS and
+// the issuer, audience, expiration and nonce claims.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, idToken string, nonce string) (OIDCClaims, error) {
+	split := strings.Split(idToken, ".")
+	if len(split) != 3 {
+		return OIDCClaims{}, errors.New("Invalid ID token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyId     string `json:"kid"`
+	}
+	if err := decodeSegment(split[0], &header); err != nil {
+		return OIDCClaims{}, err
+	}
+	if header.Algorithm != "RS256" {
+		return OIDCClaims{}, fmt.Errorf("unsupported ID token algorithm %s", header.Algorithm)
+	}
+
+	key, err := p.key(ctx, header.KeyId)
+	if err != nil {
+		return OIDCClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(split[2])
+	if err != nil {
+		return OIDCClaims{}, err
+	}
+	hash := sha256.Sum256([]byte(split[0] + "." + split[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return OIDCClaims{}, errors.New("Invalid ID token signature")
+	}
+
+	var claims OIDCClaims
+	if err := decodeSegment(split[1], &claims); err != nil {
+		return OIDCClaims{}, err
+	}
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return OIDCClaims{}, errors.New("ID token from another issuer")
+	case !hasAudience(claims.Audience, p.config.ClientId):
+		return OIDCClaims{}, errors.New("ID token for another client")
+	case claims.Expiration < time.Now().Unix():
+		return OIDCClaims{}, errors.New("Expired ID token")
+	case claims.Nonce != nonce:
+		return OIDCClaims{}, errors.New("ID token nonce doesn't match")
+	case claims.Subject == "":
+		return OIDCClaims{}, errors.New("ID token without subject")
+	}
+
+	return claims, nil
+}
+
+// key returns the signing key, fetching the JWKS again when it's unknown in
+// case the provider rotated its keys.
+func (p *OIDCProvider) key(ctx context.Context, keyId string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[keyId]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyId   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, p.client, p.jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.KeyId] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown ID token key %s", keyId)
+	}
+	return key, nil
+}
+
+func hasAudience(audience any, clientId string) bool {
+	switch aud := audience.(type) {
+	case string:
+		return aud == clientId
+	case []any:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Identity is a subject of an identity provider linked to a local user.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// IdentityRepository links the subjects of the identity provider to local users.
+type IdentityRepository interface {
+	GetUserId(ctx context.Context, issuer string, subject string) (int64, error)
+	Link(ctx context.Context, issuer string, subject string, userId int64) error
+	ByUser(ctx context.Context, userId int64) ([]Identity, error)
+}
+
+type identityRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewIdentityRepo(dbConnection *sql.DB) IdentityRepository {
+	return identityRepo{dbConnection}
+}
+
+func (r identityRepo) GetUserId(ctx context.Context, issuer string, subject string) (int64, error) {
+	query := fmt.Sprintf("SELECT user_id FROM %s WHERE issuer=$1 AND subject=$2;", OIDC_IDENTITIES_TABLE_NAME)
+	var userId int64
+	err := r.dbConnection.QueryRowContext(ctx, query, issuer, subject).Scan(&userId)
+
+	return userId, err
+}
+
+func (r identityRepo) Link(ctx context.Context, issuer string, subject string, userId int64) error {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (issuer, subject, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;",
+		OIDC_IDENTITIES_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(ctx, query, issuer, subject, userId)
+
+	return err
+}
+
+func (r identityRepo) ByUser(ctx context.Context, userId int64) ([]Identity, error) {
+	query := fmt.Sprintf("SELECT issuer, subject FROM %s WHERE user_id=$1 ORDER BY issuer, subject;", OIDC_IDENTITIES_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err := rows.Scan(&identity.Issuer, &identity.Subject); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const OIDC_STATE_COOKIE = "oidc_state"
+const OIDC_LOGIN_TIMEOUT = 10 * time.Minute
+
+// oidcState is kept in a signed cookie between the redirect to the identity
+// provider and the callback, so no server side storage is needed.
+type oidcState struct {
+	State    string
+	Verifier string
+	Nonce    string
+	Expires  int64
+}
+
+type oidcHandler struct {
+	provider   *OIDCProvider
+	identities IdentityRepository
+	userRepo   UserRepository
+	passwords  *Passwords
+	sessions   *Sessions
+	logger     *logging.Logger
+}
+
+func NewOIDCHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	provider *OIDCProvider,
+	identities IdentityRepository,
+	userRepo UserRepository,
+	passwords *Passwords,
+	sessions *Sessions,
+) http.Handler {
+	return oidcHandler{provider, identities, userRepo, passwords, sessions, logger}
+}
+
+// oidcHandler handles GET /auth/oidc/login, which redirects to the identity
+// provider, and GET /auth/oidc/callback, where the provider sends the user
+// back and the JWT is issued. Two-factor authentication is left to the
+// provider for these logins.
+func (h oidcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/auth/oidc/login":
+		state := oidcState{
+			State:    newJti(),
+			Verifier: newJti() + newJti(),
+			Nonce:    newJti(),
+			Expires:  time.Now().Add(OIDC_LOGIN_TIMEOUT).Unix(),
+		}
+		http.SetCookie(w, h.stateCookie(encodeOIDCState(state), int(OIDC_LOGIN_TIMEOUT.Seconds())))
+		http.Redirect(w, req, h.provider.AuthURL(state.State, state.Verifier, state.Nonce), http.StatusFound)
+	case "/auth/oidc/callback":
+		http.SetCookie(w, h.stateCookie("", -1))
+		if msg := req.URL.Query().Get("error"); msg != "" {
+			util.JsonError("Login failed: "+msg, http.StatusUnauthorized, w)
+			return
+		}
+
+		cookie, err := req.Cookie(OIDC_STATE_COOKIE)
+		if err != nil {
+			util.JsonError("Login expired, start again", http.StatusBadRequest, w)
+			return
+		}
+		state, ok := decodeOIDCState(cookie.Value)
+		if !ok || state.State != req.URL.Query().Get("state") {
+			util.JsonError("Login expired, start again", http.StatusBadRequest, w)
+			return
+		}
+
+		idToken, err := h.provider.Exchange(req.Context(), req.URL.Query().Get("code"), state.Verifier)
+		if err != nil {
+			util.RequestLogger(h.logger, req).Error("error exchanging OIDC code", "error", err)
+			util.JsonError("Login failed", http.StatusUnauthorized, w)
+			return
+		}
+		claims, err := h.provider.VerifyIDToken(req.Context(), idToken, state.Nonce)
+		if err != nil {
+			util.RequestLogger(h.logger, req).Error("invalid ID token", "error", err)
+			util.JsonError("Login failed", http.StatusUnauthorized, w)
+			return
+		}
+
+		user, err := h.localUser(req.Context(), claims)
+		if errors.Is(err, errNoLocalUser) {
+			util.JsonError("There's no account for this identity", http.StatusForbidden, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		token, err := h.sessions.Start(req.Context(), user, req)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(AuthResponse{token}, http.StatusOK, w)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var errNoLocalUser = errors.New("no local user for the identity")
+
+// localUser finds the user linked to the identity. The first time, it links
+// the user with the same verified email, or creates one when sign up is allowed.
+func (h oidcHandler) localUser(ctx context.Context, claims OIDCClaims) (User, error) {
+	userId, err := h.identities.GetUserId(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return h.userRepo.GetById(ctx, userId)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return User{}, errNoLocalUser
+	}
+
+	user, err := h.userRepo.Get(ctx, claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !h.provider.config.AllowSignUp {
+			return User{}, errNoLocalUser
+		}
+		user, err = h.signUp(ctx, claims.Email)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, h.identities.Link(ctx, claims.Issuer, claims.Subject, user.Id)
+}
+
+// signUp creates a user with a random password, it can be set later with a
+// password reset if the user wants to log in without the provider.
+func (h oidcHandler) signUp(ctx context.Context, email string) (User, error) {
+	password, _ := newToken()
+	passwordHash, err := h.passwords.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+	if err := h.userRepo.Create(ctx, email, passwordHash); err != nil {
+		return User{}, err
+	}
+	user, err := h.userRepo.Get(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	user.EmailVerified = true
+
+	return user, h.userRepo.MarkVerified(ctx, user.Id)
+}
+
+func (h oidcHandler) stateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.provider.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func encodeOIDCState(state oidcState) string {
+	b, _ := json.Marshal(state)
+	value := base64.RawURLEncoding.EncodeToString(b)
+	return value + "." + sign(value)
+}
+
+func decodeOIDCState(cookie string) (oidcState, bool) {
+	value, signature, found := strings.Cut(cookie, ".")
+	if !found || !hmac.Equal([]byte(sign(value)), []byte(signature)) {
+		return oidcState{}, false
+	}
+
+	var state oidcState
+	if err := decodeSegment(value, &state); err != nil || state.Expires < time.Now().Unix() {
+		return oidcState{}, false
+	}
+	return state, true
+}
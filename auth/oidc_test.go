@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+// stubProvider is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint checking the PKCE verifier of the codes registered by the test.
+type stubProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]stubCode
+}
+
+type stubCode struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	check(err, t)
+	p := &stubProvider{key: key, codes: map[string]stubCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code, ok := p.codes[r.FormValue("code")]
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(code.claims)})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *stubProvider) idToken(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *stubProvider) claims(nonce string) map[string]any {
+	return map[string]any{
+		"iss":            p.server.URL,
+		"sub":            "subject-1",
+		"aud":            "client",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "sso@test.com",
+		"email_verified": true,
+	}
+}
+
+type fakeIdentities map[string]int64
+
+func (f fakeIdentities) GetUserId(ctx context.Context, issuer string, subject string) (int64, error) {
+	userId, ok := f[issuer+subject]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return userId, nil
+}
+
+func (f fakeIdentities) Link(ctx context.Context, issuer string, subject string, userId int64) error {
+	f[issuer+subject] = userId
+	return nil
+}
+
+func (f fakeIdentities) ByUser(ctx context.Context, userId int64) ([]Identity, error) {
+	return []Identity{}, nil
+}
+
+func newTestOIDCProvider(t *testing.T, stub *stubProvider, allowSignUp bool) *OIDCProvider {
+	config := OIDCConfig{
+		Issuer:      stub.server.URL,
+		ClientId:    "client",
+		RedirectURL: "http://test/auth/oidc/callback",
+		AllowSignUp: allowSignUp,
+	}
+	provider, err := NewOIDCProvider(context.Background(), config, stub.server.Client())
+	check(err, t)
+	return provider
+}
+
+// oidcLogin goes through the whole flow, with the test acting as the user
+// logging in at the provider.
+func oidcLogin(t *testing.T, handler http.Handler, stub *stubProvider) *http.Response {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login should redirect to the provider, got %d", recorder.Code)
+	}
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	params := location.Query()
+	if params.Get("code_challenge_method") != "S256" {
+		t.Fatal("login should use PKCE")
+	}
+	stub.codes["code1"] = stubCode{params.Get("code_challenge"), stub.claims(params.Get("nonce"))}
+
+	callback := httptest.NewRequest("GET", "/auth/oidc/callback?code=code1&state="+params.Get("state"), nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, callback)
+
+	return recorder.Result()
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	stub := newStubProvider(t)
+	users := fakeUsers{}
+	identities := fakeIdentities{}
+	handler := NewOIDCHandler(context.Background(), logging.Default(), newTestOIDCProvider(t, stub, true), identities, users, testPasswords, newTestSessions(t))
+
+	result := oidcLogin(t, handler, stub)
+
+	if result.StatusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", result.StatusCode)
+	}
+	var body AuthResponse
+	json.NewDecoder(result.Body).Decode(&body)
+	user, err := users.Get(context.Background(), "sso@test.com")
+	if err != nil || !user.EmailVerified {
+		t.Fatal("a verified user should be created")
+	}
+	if identities[stub.server.URL+"subject-1"] != user.Id {
+		t.Fatal("the identity should be linked to the user")
+	}
+	if !validJWT(body.JWT) {
+		t.Fatal("invalid JWT")
+	}
+}
+
+func TestOIDCLoginWithoutSignUp(t *testing.T) {
+	stub := newStubProvider(t)
+	handler := NewOIDCHandler(context.Background(), logging.Default(), newTestOIDCProvider(t, stub, false), fakeIdentities{}, fakeUsers{}, testPasswords, newTestSessions(t))
+
+	if result := oidcLogin(t, handler, stub); result.StatusCode != 403 {
+		t.Fatalf("Status code should be 403 but is %d", result.StatusCode)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := newTestOIDCProvider(t, stub, false)
+	ctx := context.Background()
+
+	if _, err := provider.VerifyIDToken(ctx, stub.idToken(stub.claims("nonce")), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(map[string]any){
+		"other nonce":    func(c map[string]any) { c["nonce"] = "other" },
+		"other audience": func(c map[string]any) { c["aud"] = "other" },
+		"other issuer":   func(c map[string]any) { c["iss"] = "http://evil" },
+		"expired":        func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+	}
+	for name, change := range cases {
+		claims := stub.claims("nonce")
+		change(claims)
+		if _, err := provider.VerifyIDToken(ctx, stub.idToken(claims), "nonce"); err == nil {
+			t.Errorf("%s: ID token should be rejected", name)
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forger := &stubProvider{server: stub.server, key: otherKey}
+	if _, err := provider.VerifyIDToken(ctx, forger.idToken(stub.claims("nonce")), "nonce"); err == nil {
+		t.Error("ID tokens signed with other keys should be rejected")
+	}
+}
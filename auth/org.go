@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const ORGANIZATIONS_TABLE_NAME = "organizations"
+const MEMBERSHIPS_TABLE_NAME = "memberships"
+
+type Organization struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type Member struct {
+	UserId int64  `json:"user_id"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+}
+
+type OrgRepository interface {
+	Create(ctx context.Context, name string, ownerId int64) (int64, error)
+	GetAll(ctx context.Context, userId int64) ([]Organization, error)
+	DefaultOrg(ctx context.Context, userId int64) (int64, error)
+	Role(ctx context.Context, orgId int64, userId int64) (string, error)
+	Members(ctx context.Context, orgId int64) ([]Member, error)
+	SetRole(ctx context.Context, orgId int64, userId int64, role string) (bool, error)
+	RemoveMember(ctx context.Context, orgId int64, userId int64) (bool, error)
+}
+
+type orgRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewOrgRepo(dbConnection *sql.DB) OrgRepository {
+	return orgRepo{dbConnection}
+}
+
+func (r orgRepo) Create(ctx context.Context, name string, ownerId int64) (int64, error) {
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	orgId, err := insertOrg(ctx, tx, name, ownerId)
+	if err != nil {
+		return 0, err
+	}
+
+	return orgId, tx.Commit()
+}
+
+func insertOrg(ctx context.Context, tx *sql.Tx, name string, ownerId int64) (int64, error) {
+	query := fmt.Sprintf("INSERT INTO %s (name) VALUES ($1) RETURNING id;", ORGANIZATIONS_TABLE_NAME)
+	var orgId int64
+	if err := tx.QueryRowContext(ctx, query, name).Scan(&orgId); err != nil {
+		return 0, err
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (org_id, user_id, role) VALUES ($1, $2, $3);", MEMBERSHIPS_TABLE_NAME)
+	_, err := tx.ExecContext(ctx, query, orgId, ownerId, ROLE_OWNER)
+
+	return orgId, err
+}
+
+func (r orgRepo) GetAll(ctx context.Context, userId int64) ([]Organization, error) {
+	query := fmt.Sprintf(
+		"SELECT o.id, o.name FROM %s o JOIN %s m ON m.org_id = o.id WHERE m.user_id=$1 ORDER BY o.id;",
+		ORGANIZATIONS_TABLE_NAME,
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	rows, err := r.dbConnection.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var org Organization
+		if err := rows.Scan(&org.Id, &org.Name); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// DefaultOrg is the organization used when a request doesn't pick one, the
+// personal one created on sign up. Joining other organizations never changes it.
+func (r orgRepo) DefaultOrg(ctx context.Context, userId int64) (int64, error) {
+	query := fmt.Sprintf("SELECT default_org_id FROM %s WHERE id=$1;", USERS_TABLE_NAME)
+	var orgId sql.NullInt64
+	if err := r.dbConnection.QueryRowContext(ctx, query, userId).Scan(&orgId); err != nil {
+		return 0, err
+	}
+	if !orgId.Valid {
+		return 0, sql.ErrNoRows
+	}
+
+	return orgId.Int64, nil
+}
+
+// Role returns sql.ErrNoRows when the user isn't a member of the organization.
+func (r orgRepo) Role(ctx context.Context, orgId int64, userId int64) (string, error) {
+	query := fmt.Sprintf("SELECT role FROM %s WHERE org_id=$1 AND user_id=$2;", MEMBERSHIPS_TABLE_NAME)
+	var role string
+	err := r.dbConnection.QueryRowContext(ctx, query, orgId, userId).Scan(&role)
+
+	return role, err
+}
+
+func (r orgRepo) Members(ctx context.Context, orgId int64) ([]Member, error) {
+	query := fmt.Sprintf(
+		"SELECT u.id, u.email, m.role FROM %s u JOIN %s m ON m.user_id = u.id "+
+			"WHERE m.org_id=$1 AND u.service_org_id IS NULL ORDER BY u.id;",
+		USERS_TABLE_NAME,
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	rows, err := r.dbConnection.QueryContext(ctx, query, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var member Member
+		if err := rows.Scan(&member.UserId, &member.Email, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (r orgRepo) SetRole(ctx context.Context, orgId int64, userId int64, role string) (bool, error) {
+	query := fmt.Sprintf("UPDATE %s SET role=$3 WHERE org_id=$1 AND user_id=$2;", MEMBERSHIPS_TABLE_NAME)
+	res, err := r.dbConnection.ExecContext(ctx, query, orgId, userId, role)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
+
+func (r orgRepo) RemoveMember(ctx context.Context, orgId int64, userId int64) (bool, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE org_id=$1 AND user_id=$2;", MEMBERSHIPS_TABLE_NAME)
+	res, err := r.dbConnection.ExecContext(ctx, query, orgId, userId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
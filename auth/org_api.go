@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type createOrgBody struct {
+	Name string `json:"name"`
+}
+
+type setRoleBody struct {
+	Role string `json:"role"`
+}
+
+type orgHandler struct {
+	repo   OrgRepository
+	logger *logging.Logger
+}
+
+type membersHandler struct {
+	repo   OrgRepository
+	logger *logging.Logger
+}
+
+func NewOrgHandler(ctx context.Context, logger *logging.Logger, repo OrgRepository) http.Handler {
+	return orgHandler{repo, logger}
+}
+
+func NewMembersHandler(ctx context.Context, logger *logging.Logger, repo OrgRepository) http.Handler {
+	return membersHandler{repo, logger}
+}
+
+func (h orgHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage organizations", http.StatusForbidden, w)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		orgs, err := h.repo.GetAll(req.Context(), principal.UserId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(orgs, http.StatusOK, w)
+	case "POST":
+		defer req.Body.Close()
+		var body createOrgBody
+		err = json.NewDecoder(req.Body).Decode(&body)
+		if err != nil || body.Name == "" {
+			util.JsonError("'name' is required", http.StatusBadRequest, w)
+			return
+		}
+
+		id, err := h.repo.Create(req.Context(), body.Name, principal.UserId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(Organization{id, body.Name}, http.StatusCreated, w)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+// membersHandler manages the members of the organization the request acts on,
+// new members only join by accepting an invitation.
+func (h membersHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage organizations", http.StatusForbidden, w)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		if !Authorize(w, req, ACTION_READ_MEMBERS) {
+			return
+		}
+		members, err := h.repo.Members(req.Context(), principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(members, http.StatusOK, w)
+	case "PUT":
+		if !Authorize(w, req, ACTION_MANAGE_MEMBERS) {
+			return
+		}
+		userId, ok := memberIdFromPath(req, w)
+		if !ok {
+			return
+		}
+		defer req.Body.Close()
+		var body setRoleBody
+		err = json.NewDecoder(req.Body).Decode(&body)
+		if err != nil || body.Role == "" {
+			util.JsonError("'role' is required", http.StatusBadRequest, w)
+			return
+		}
+		if !checkAssignableRole(principal, body.Role, w) {
+			return
+		}
+		members, ok := h.editableMembers(req.Context(), principal, userId, w)
+		if !ok {
+			return
+		}
+		if body.Role != ROLE_OWNER && isLastOwner(members, userId) {
+			util.JsonError("An organization needs at least one owner", http.StatusBadRequest, w)
+			return
+		}
+
+		_, err = h.repo.SetRole(req.Context(), principal.OrgId, userId, body.Role)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "DELETE":
+		userId, ok := memberIdFromPath(req, w)
+		if !ok {
+			return
+		}
+		// anyone can leave, removing others needs permission
+		if userId != principal.UserId && !Authorize(w, req, ACTION_MANAGE_MEMBERS) {
+			return
+		}
+		members, ok := h.editableMembers(req.Context(), principal, userId, w)
+		if !ok {
+			return
+		}
+		if isLastOwner(members, userId) {
+			util.JsonError("An organization needs at least one owner", http.StatusBadRequest, w)
+			return
+		}
+
+		_, err = h.repo.RemoveMember(req.Context(), principal.OrgId, userId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+// editableMembers loads the members of the organization checking the target
+// exists and has a role the caller is allowed to change.
+func (h membersHandler) editableMembers(ctx context.Context, principal Principal, userId int64, w http.ResponseWriter) ([]Member, bool) {
+	members, err := h.repo.Members(ctx, principal.OrgId)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return nil, false
+	}
+	for _, m := range members {
+		if m.UserId != userId {
+			continue
+		}
+		if userId != principal.UserId && !hasRole(principal.Role, m.Role) {
+			util.JsonError("Can't change a member with a higher role", http.StatusForbidden, w)
+			return nil, false
+		}
+		return members, true
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	return nil, false
+}
+
+func memberIdFromPath(req *http.Request, w http.ResponseWriter) (int64, bool) {
+	userId, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/orgs/members/"), 10, 64)
+	if err != nil {
+		util.JsonError("A valid user id is required: /orgs/members/<id>", http.StatusBadRequest, w)
+		return 0, false
+	}
+	return userId, true
+}
+
+func checkAssignableRole(principal Principal, role string, w http.ResponseWriter) bool {
+	if !isValidRole(role) {
+		util.JsonError("'role' must be one of owner, admin, editor or viewer", http.StatusBadRequest, w)
+		return false
+	}
+	if !hasRole(principal.Role, role) {
+		util.JsonError("Can't grant a role higher than yours", http.StatusForbidden, w)
+		return false
+	}
+	return true
+}
+
+func isLastOwner(members []Member, userId int64) bool {
+	owners := 0
+	isOwner := false
+	for _, m := range members {
+		if m.Role == ROLE_OWNER {
+			owners++
+			isOwner = isOwner || m.UserId == userId
+		}
+	}
+	return isOwner && owners == 1
+}
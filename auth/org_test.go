@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+// fakeOrgRepo holds the members of every organization, org id -> user id -> role,
+// and the default organization of every user.
+type fakeOrgRepo struct {
+	members  map[int64]map[int64]string
+	defaults map[int64]int64
+}
+
+func (r fakeOrgRepo) Create(ctx context.Context, name string, ownerId int64) (int64, error) {
+	id := int64(len(r.members) + 1)
+	r.members[id] = map[int64]string{ownerId: ROLE_OWNER}
+	return id, nil
+}
+
+func (r fakeOrgRepo) GetAll(ctx context.Context, userId int64) ([]Organization, error) {
+	return []Organization{}, nil
+}
+
+func (r fakeOrgRepo) DefaultOrg(ctx context.Context, userId int64) (int64, error) {
+	orgId, ok := r.defaults[userId]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return orgId, nil
+}
+
+func (r fakeOrgRepo) Role(ctx context.Context, orgId int64, userId int64) (string, error) {
+	role, ok := r.members[orgId][userId]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return role, nil
+}
+
+func (r fakeOrgRepo) Members(ctx context.Context, orgId int64) ([]Member, error) {
+	members := []Member{}
+	for id, role := range r.members[orgId] {
+		members = append(members, Member{UserId: id, Role: role})
+	}
+	return members, nil
+}
+
+func (r fakeOrgRepo) SetRole(ctx context.Context, orgId int64, userId int64, role string) (bool, error) {
+	_, ok := r.members[orgId][userId]
+	r.members[orgId][userId] = role
+	return ok, nil
+}
+
+func (r fakeOrgRepo) RemoveMember(ctx context.Context, orgId int64, userId int64) (bool, error) {
+	_, ok := r.members[orgId][userId]
+	delete(r.members[orgId], userId)
+	return ok, nil
+}
+
+func newTestOrgRepo() fakeOrgRepo {
+	return fakeOrgRepo{
+		map[int64]map[int64]string{
+			1: {10: ROLE_OWNER},
+			2: {10: ROLE_ADMIN, 11: ROLE_OWNER, 12: ROLE_EDITOR},
+			3: {11: ROLE_OWNER},
+		},
+		map[int64]int64{10: 1, 11: 3},
+	}
+}
+
+func serveMembers(orgs OrgRepository, principal Principal, method string, path string, body string) int {
+	handler := NewMembersHandler(context.Background(), logging.Default(), orgs)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request = request.WithContext(WithPrincipal(request.Context(), principal))
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Result().StatusCode
+}
+
+func TestAuthMiddlewareResolvesOrg(t *testing.T) {
+	cases := []struct {
+		userId     int64
+		header     string
+		statusCode int
+		orgId      int64
+	}{
+		{10, "", 200, 1},
+		{10, "2", 200, 2},
+		{10, "3", 403, 0},
+		{10, "nope", 403, 0},
+		// the personal organization, even after joining one created before
+		{11, "", 200, 3},
+		{12, "", 403, 0},
+	}
+
+	for _, c := range cases {
+		var principal Principal
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ = GetPrincipal(r)
+		})
+		repo := fakeAPIKeyRepo{map[string]APIKey{}}
+		handler := AuthMiddleware(newTestRevocationList(t), newTestSessions(t), repo, newTestOrgRepo())(next)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/toggles", nil)
+		request.Header.Add("Authorization", generateJWT(User{Id: c.userId}))
+		if c.header != "" {
+			request.Header.Add(ORG_HEADER, c.header)
+		}
+
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != c.statusCode {
+			t.Errorf("user %d, org '%s': status code should be %d but is %d", c.userId, c.header, c.statusCode, recorder.Result().StatusCode)
+		}
+		if principal.OrgId != c.orgId {
+			t.Errorf("user %d, org '%s': org should be %d but is %d", c.userId, c.header, c.orgId, principal.OrgId)
+		}
+	}
+}
+
+func TestMembersRBAC(t *testing.T) {
+	admin := Principal{UserId: 10, OrgId: 2, Role: ROLE_ADMIN}
+	editor := Principal{UserId: 12, OrgId: 2, Role: ROLE_EDITOR}
+	owner := Principal{UserId: 11, OrgId: 2, Role: ROLE_OWNER}
+	cases := []struct {
+		name       string
+		principal  Principal
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"viewers can list", editor, "GET", "/orgs/members", "", 200},
+		{"members join through invitations", owner, "POST", "/orgs/members", `{"email": "new@test.com"}`, 405},
+		{"admins can't grant owner", admin, "PUT", "/orgs/members/12", `{"role": "owner"}`, 403},
+		{"unknown role", admin, "PUT", "/orgs/members/12", `{"role": "boss"}`, 400},
+		{"admins can promote editors", admin, "PUT", "/orgs/members/12", `{"role": "admin"}`, 200},
+		{"admins can't demote owners", admin, "PUT", "/orgs/members/11", `{"role": "viewer"}`, 403},
+		{"last owner can't step down", owner, "PUT", "/orgs/members/11", `{"role": "admin"}`, 400},
+		{"last owner can't leave", owner, "DELETE", "/orgs/members/11", "", 400},
+		{"editors can leave", editor, "DELETE", "/orgs/members/12", "", 200},
+		{"editors can't remove others", editor, "DELETE", "/orgs/members/10", "", 403},
+		{"unknown member", owner, "DELETE", "/orgs/members/99", "", 404},
+	}
+
+	for _, c := range cases {
+		statusCode := serveMembers(newTestOrgRepo(), c.principal, c.method, c.path, c.body)
+		if statusCode != c.statusCode {
+			t.Errorf("%s: status code should be %d but is %d", c.name, c.statusCode, statusCode)
+		}
+	}
+}
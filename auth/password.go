@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	bcrypt "golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything after the first 72 bytes.
+const MAX_PASSWORD_BYTES = 72
+
+type PasswordPolicy struct {
+	MinLength int
+	// Breached holds lowercased passwords known to be leaked.
+	Breached map[string]bool
+}
+
+// Passwords checks new passwords against the policy and hashes them with
+// the configured bcrypt cost.
+type Passwords struct {
+	policy PasswordPolicy
+	cost   int
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+func NewPasswords(policy PasswordPolicy, cost int) (*Passwords, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &Passwords{policy: policy, cost: cost}, nil
+}
+
+// LoadBreachedPasswords reads a file with one password per line.
+func LoadBreachedPasswords(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			breached[strings.ToLower(line)] = true
+		}
+	}
+
+	return breached, scanner.Err()
+}
+
+// Check returns an error meant to be shown to the user when the password
+// doesn't follow the policy.
+func (p *Passwords) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.policy.MinLength {
+		return fmt.Errorf("Password must be at least %d characters long", p.policy.MinLength)
+	}
+	if len(password) > MAX_PASSWORD_BYTES {
+		return fmt.Errorf("Password must be at most %d bytes long", MAX_PASSWORD_BYTES)
+	}
+	if p.policy.Breached[strings.ToLower(password)] {
+		return errors.New("Password is known to be leaked, choose another one")
+	}
+	return nil
+}
+
+func (p *Passwords) Hash(password string) (string, error) {
+	return hashPass(password, p.cost)
+}
+
+// NeedsRehash tells if the hash was made with a cost other than the configured one.
+func (p *Passwords) NeedsRehash(passwordHash string) bool {
+	cost, err := bcrypt.Cost([]byte(passwordHash))
+	return err == nil && cost != p.cost
+}
+
+func hashPass(password string, cost int) (string, error) {
+	r, e := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if e != nil {
+		return "", e
+	}
+	return string(r), nil
+}
+
+// dummyHash is checked when there's no user to check the password against,
+// so the response takes as long as when there is one. It's made with the
+// configured cost, like the hashes of real users.
+func (p *Passwords) dummyHash() string {
+	p.dummyOnce.Do(func() {
+		p.dummy, _ = hashPass("not a real password", p.cost)
+	})
+	return p.dummy
+}
+
+func validatePass(password string, passwordHash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	return err == nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	bcrypt "golang.org/x/crypto/bcrypt"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+var testPasswords, _ = NewPasswords(PasswordPolicy{MinLength: 8}, bcrypt.MinCost)
+
+// fakeUpdates records the password hashes stored for every user.
+type fakeUpdates struct {
+	fakeRepo
+	updated map[int64]string
+}
+
+func (fu fakeUpdates) UpdatePassword(ctx context.Context, userId int64, passwordHash string) error {
+	fu.updated[userId] = passwordHash
+	return nil
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	passwords, err := NewPasswords(PasswordPolicy{MinLength: 8, Breached: map[string]bool{"password123": true}}, bcrypt.MinCost)
+	check(err, t)
+
+	cases := map[string]bool{
+		"short":                 false,
+		"long enough":           true,
+		"Password123":           false,
+		strings.Repeat("a", 72): true,
+		strings.Repeat("a", 73): false,
+		"contraseña":            true,
+	}
+	for password, valid := range cases {
+		if err := passwords.Check(password); (err == nil) != valid {
+			t.Errorf("'%s' valid should be %t but got: %v", password, valid, err)
+		}
+	}
+}
+
+func TestInvalidBcryptCost(t *testing.T) {
+	if _, err := NewPasswords(PasswordPolicy{}, 99); err == nil {
+		t.Fatal("costs above bcrypt's maximum should be rejected")
+	}
+}
+
+func TestSignUpWeakPassword(t *testing.T) {
+	handler := NewSignUpHandler(context.Background(), logging.Default(), fakeUsers{}, testPasswords, newTestAccountMailer())
+
+	if statusCode := post(handler, "/signup", `{"email": "new@test.com", "password": "1234"}`); statusCode != 400 {
+		t.Fatalf("Status code should be 400 but is %d", statusCode)
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	oldHash, _ := hashPass("pass1234", bcrypt.MinCost)
+	user := User{Id: 10, Email: "test@test.com", PasswordHash: oldHash, EmailVerified: true}
+	repo := fakeUpdates{fakeRepo{user}, map[int64]string{}}
+	passwords, _ := NewPasswords(PasswordPolicy{}, bcrypt.MinCost+1)
+	handler := NewAuthUpHandler(context.Background(), logging.Default(), repo, passwords, newFakeTwoFactorRepo(), newTestThrottle(), newTestSessions(t))
+
+	if statusCode := post(handler, "/auth", `{"email": "test@test.com", "password": "pass1234"}`); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+
+	cost, err := bcrypt.Cost([]byte(repo.updated[10]))
+	if err != nil || cost != bcrypt.MinCost+1 {
+		t.Fatal("password should be rehashed with the configured cost")
+	}
+	if !validatePass("pass1234", repo.updated[10]) {
+		t.Fatal("new hash should match the password")
+	}
+}
+
+func TestDummyHashUsesConfiguredCost(t *testing.T) {
+	passwords, _ := NewPasswords(PasswordPolicy{}, bcrypt.MinCost+1)
+
+	cost, err := bcrypt.Cost([]byte(passwords.dummyHash()))
+	if err != nil || cost != bcrypt.MinCost+1 {
+		t.Fatalf("dummy hash should cost %d like real hashes but costs %d", bcrypt.MinCost+1, cost)
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/audit"
+)
+
+type principalKey struct{}
+
+// ORG_HEADER picks the organization a session acts on, defaults to the
+// personal organization of the user.
+const ORG_HEADER = "X-Organization-Id"
+
+// Principal is the authenticated caller of a request, either a user session
+// (JWT) or an API key.
+type Principal struct {
+	UserId  int64
+	OrgId   int64
+	Role    string
+	KeyId   int64
+	KeyType string
+	Scopes  []string
+	// SessionId is the jti of the session token, empty for API keys.
+	SessionId string
+	// ServiceAccount tells if UserId is a service account, which only
+	// authenticate with API keys.
+	ServiceAccount bool
+	// Environment is the one environment the API key is restricted to.
+	Environment string
+}
+
+func (p Principal) IsAPIKey() bool {
+	return p.KeyType != ""
+}
+
+// InEnvironment tells if the principal can use the toggles of the environment.
+func (p Principal) InEnvironment(environment string) bool {
+	return p.Environment == "" || p.Environment == environment
+}
+
+// AuditEvent describes an action of the principal for the audit log, service
+// accounts are recorded as such instead of as users.
+func AuditEvent(req *http.Request, principal Principal, action string, target string) audit.Event {
+	actorType := audit.ACTOR_USER
+	if principal.ServiceAccount {
+		actorType = audit.ACTOR_SERVICE_ACCOUNT
+	}
+	return audit.Event{
+		OrgId:     principal.OrgId,
+		ActorType: actorType,
+		ActorId:   principal.UserId,
+		Action:    action,
+		Target:    target,
+		IP:        clientIP(req),
+	}
+}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+var errNoPrincipal = errors.New("no principal in the request, is it behind AuthMiddleware?")
+
+// GetPrincipal returns the caller stored by AuthMiddleware. Handlers serving
+// requests that didn't go through it get an error, the Authorization header
+// alone is never trusted.
+func GetPrincipal(req *http.Request) (Principal, error) {
+	if p, ok := req.Context().Value(principalKey{}).(Principal); ok {
+		return p, nil
+	}
+
+	return Principal{}, errNoPrincipal
+}
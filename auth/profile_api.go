@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const MAX_DISPLAY_NAME_LENGTH = 50
+
+type ProfileResponse struct {
+	Id            int64  `json:"id"`
+	Email         string `json:"email"`
+	DisplayName   string `json:"display_name"`
+	EmailVerified bool   `json:"email_verified"`
+	PendingEmail  string `json:"pending_email,omitempty"`
+}
+
+// updateProfileBody only changes the fields that are present, changing the
+// email requires the current password and applies once the new email is
+// verified.
+type updateProfileBody struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+	Password    string  `json:"password"`
+}
+
+type changePasswordBody struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+type passwordBody struct {
+	Password string `json:"password"`
+}
+
+type profileHandler struct {
+	repo        UserRepository
+	passwords   *Passwords
+	mailer      *AccountMailer
+	revocations *RevocationList
+	sessions    *Sessions
+	throttle    *LoginThrottle
+	logger      *logging.Logger
+}
+
+func NewProfileHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo UserRepository,
+	passwords *Passwords,
+	mailer *AccountMailer,
+	revocations *RevocationList,
+	sessions *Sessions,
+	throttle *LoginThrottle,
+) http.Handler {
+	return profileHandler{repo, passwords, mailer, revocations, sessions, throttle, logger}
+}
+
+// profileHandler manages the account of the caller: GET and PATCH /me for
+// the profile, POST /me/password to change the password and DELETE /me to
+// remove the account.
+func (h profileHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage the account", http.StatusForbidden, w)
+		return
+	}
+
+	user, err := h.repo.GetById(req.Context(), principal.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	defer req.Body.Close()
+
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/me":
+		util.JsonResponse(profileResponse(user), http.StatusOK, w)
+	case req.Method == http.MethodPatch && req.URL.Path == "/me":
+		h.updateProfile(user, w, req)
+	case req.Method == http.MethodPost && req.URL.Path == "/me/password":
+		h.changePassword(user, w, req)
+	case req.Method == http.MethodDelete && req.URL.Path == "/me":
+		var body passwordBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if !h.checkPassword(w, req, user, body.Password) {
+			return
+		}
+
+		err = h.repo.Delete(req.Context(), user.Id)
+		if errors.Is(err, errLastOwner) {
+			util.JsonError("Transfer the ownership of your organizations with other members first", http.StatusConflict, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		// sessions of deleted users aren't members of any organization
+		// anymore, so AuthMiddleware rejects them
+		util.RequestLogger(h.logger, req).Info("account deleted", "user_id", user.Id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h profileHandler) updateProfile(user User, w http.ResponseWriter, req *http.Request) {
+	var body updateProfileBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		util.JsonError("Invalid body", http.StatusBadRequest, w)
+		return
+	}
+
+	if body.DisplayName != nil {
+		if utf8.RuneCountInString(*body.DisplayName) > MAX_DISPLAY_NAME_LENGTH {
+			util.JsonError("'display_name' is too long", http.StatusBadRequest, w)
+			return
+		}
+		if err := h.repo.UpdateDisplayName(req.Context(), user.Id, *body.DisplayName); err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		user.DisplayName = *body.DisplayName
+	}
+
+	if body.Email != nil && *body.Email != user.Email {
+		if *body.Email == "" {
+			util.JsonError("'email' can't be empty", http.StatusBadRequest, w)
+			return
+		}
+		if !h.checkPassword(w, req, user, body.Password) {
+			return
+		}
+		_, err := h.repo.Get(req.Context(), *body.Email)
+		if err == nil {
+			util.JsonError("Email already in use", http.StatusConflict, w)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		err = h.repo.SetPendingEmail(req.Context(), user.Id, *body.Email)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if err := h.mailer.SendEmailChange(req.Context(), user, *body.Email); err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if err := h.mailer.NotifyEmailChange(req.Context(), user, *body.Email); err != nil {
+			util.RequestLogger(h.logger, req).Error("error sending email change notice", "error", err)
+		}
+		user.PendingEmail = *body.Email
+	}
+
+	util.JsonResponse(profileResponse(user), http.StatusOK, w)
+}
+
+func profileResponse(user User) ProfileResponse {
+	return ProfileResponse{user.Id, user.Email, user.DisplayName, user.EmailVerified, user.PendingEmail}
+}
+
+// changePassword logs out every session of the user and returns a new token
+// for the caller.
+func (h profileHandler) changePassword(user User, w http.ResponseWriter, req *http.Request) {
+	var body changePasswordBody
+	json.NewDecoder(req.Body).Decode(&body)
+	if body.CurrentPassword == "" || body.Password == "" {
+		util.JsonError("Both 'current_password' and 'password' are required", http.StatusBadRequest, w)
+		return
+	}
+	if !h.checkPassword(w, req, user, body.CurrentPassword) {
+		return
+	}
+	if err := h.passwords.Check(body.Password); err != nil {
+		util.JsonError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+
+	hash, err := h.passwords.Hash(body.Password)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	err = h.repo.UpdatePassword(req.Context(), user.Id, hash)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	err = h.revocations.RevokeUser(req.Context(), user.Id)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	user, err = h.repo.GetById(req.Context(), user.Id)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	token, err := h.sessions.Start(req.Context(), user, req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	util.JsonResponse(AuthResponse{token}, http.StatusOK, w)
+}
+
+// checkPassword confirms the password of the caller, responding when it
+// doesn't match. Failures count towards the lockout of logins, a stolen
+// session can't be used to guess the password.
+func (h profileHandler) checkPassword(w http.ResponseWriter, req *http.Request, user User, password string) bool {
+	ip := clientIP(req)
+	if lockedOut(h.throttle, user.Email, ip, w) {
+		return false
+	}
+	if !validatePass(password, user.PasswordHash) {
+		loginFailure(h.throttle, h.logger, req, user.Email, ip, w)
+		return false
+	}
+	h.throttle.Success(user.Email)
+	return true
+}
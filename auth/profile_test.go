@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
+)
+
+func newTestProfile(t *testing.T) (http.Handler, fakeUsers, *[]mail.Message) {
+	hash, err := testPasswords.Hash("pass1234")
+	check(err, t)
+	users := fakeUsers{"me@test.com": User{Id: 10, Email: "me@test.com", PasswordHash: hash, EmailVerified: true}}
+	var sent []mail.Message
+	mailer := NewAccountMailer(fakeTokenRepo{}, fakeMailer{&sent}, "http://test")
+	handler := NewProfileHandler(context.Background(), logging.Default(), users, testPasswords, mailer, newTestRevocationList(t), newTestSessions(t), newTestThrottle())
+
+	return handler, users, &sent
+}
+
+func serveProfile(handler http.Handler, method string, path string, body string) *http.Response {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	principal := Principal{UserId: 10, OrgId: 1, Role: ROLE_OWNER, Scopes: sessionScopes(false)}
+	handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+
+	return recorder.Result()
+}
+
+func TestGetProfile(t *testing.T) {
+	handler, _, _ := newTestProfile(t)
+
+	result := serveProfile(handler, "GET", "/me", "")
+
+	var profile ProfileResponse
+	json.NewDecoder(result.Body).Decode(&profile)
+	if result.StatusCode != 200 || profile.Email != "me@test.com" || !profile.EmailVerified {
+		t.Fatalf("unexpected profile %d %+v", result.StatusCode, profile)
+	}
+}
+
+func TestUpdateDisplayName(t *testing.T) {
+	handler, users, _ := newTestProfile(t)
+
+	result := serveProfile(handler, "PATCH", "/me", `{"display_name": "Me"}`)
+
+	if result.StatusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", result.StatusCode)
+	}
+	if users["me@test.com"].DisplayName != "Me" {
+		t.Fatal("display name should be updated")
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	hash, err := testPasswords.Hash("pass1234")
+	check(err, t)
+	users := fakeUsers{
+		"me@test.com":    User{Id: 10, Email: "me@test.com", PasswordHash: hash, EmailVerified: true},
+		"taken@test.com": User{Id: 11, Email: "taken@test.com"},
+	}
+	var sent []mail.Message
+	tokens := fakeTokenRepo{}
+	mailer := NewAccountMailer(tokens, fakeMailer{&sent}, "http://test")
+	handler := NewProfileHandler(context.Background(), logging.Default(), users, testPasswords, mailer, newTestRevocationList(t), newTestSessions(t), newTestThrottle())
+	verify := NewVerifyEmailHandler(context.Background(), logging.Default(), users, tokens, mailer)
+
+	if result := serveProfile(handler, "PATCH", "/me", `{"email": "new@test.com"}`); result.StatusCode != 401 {
+		t.Fatalf("changing the email without password should fail, got %d", result.StatusCode)
+	}
+	if result := serveProfile(handler, "PATCH", "/me", `{"email": "taken@test.com", "password": "pass1234"}`); result.StatusCode != 409 {
+		t.Fatalf("Status code should be 409 but is %d", result.StatusCode)
+	}
+
+	result := serveProfile(handler, "PATCH", "/me", `{"email": "new@test.com", "password": "pass1234"}`)
+
+	var profile ProfileResponse
+	json.NewDecoder(result.Body).Decode(&profile)
+	if result.StatusCode != 200 || profile.Email != "me@test.com" || profile.PendingEmail != "new@test.com" {
+		t.Fatalf("the email should only change once verified, got %d %+v", result.StatusCode, profile)
+	}
+	if len(sent) != 2 || sent[0].To != "new@test.com" || sent[1].To != "me@test.com" {
+		t.Fatalf("a token should be mailed to the new email and a notice to the current one, got %v", sent)
+	}
+
+	replaced := mailedToken(t, sent[:1])
+	sent = sent[:0]
+	serveProfile(handler, "PATCH", "/me", `{"email": "other@test.com", "password": "pass1234"}`)
+	token := mailedToken(t, sent[:1])
+
+	if statusCode := post(verify, "/verify-email/change", `{"token": "`+replaced+`"}`); statusCode != 400 {
+		t.Fatalf("tokens of a replaced email change shouldn't apply, got %d", statusCode)
+	}
+	if statusCode := post(verify, "/verify-email/change", `{"token": "`+token+`"}`); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	user, ok := users["other@test.com"]
+	if !ok || !user.EmailVerified || user.PendingEmail != "" {
+		t.Fatalf("the email should be changed and verified, got %+v", user)
+	}
+	if statusCode := post(verify, "/verify-email/change", `{"token": "`+token+`"}`); statusCode != 400 {
+		t.Fatalf("tokens should be single use, got %d", statusCode)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	handler, users, _ := newTestProfile(t)
+
+	if result := serveProfile(handler, "POST", "/me/password", `{"current_password": "wrong", "password": "newpass123"}`); result.StatusCode != 401 {
+		t.Fatalf("Status code should be 401 but is %d", result.StatusCode)
+	}
+	if result := serveProfile(handler, "POST", "/me/password", `{"current_password": "pass1234", "password": "short"}`); result.StatusCode != 400 {
+		t.Fatalf("passwords outside the policy should be rejected, got %d", result.StatusCode)
+	}
+
+	result := serveProfile(handler, "POST", "/me/password", `{"current_password": "pass1234", "password": "newpass123"}`)
+
+	if result.StatusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", result.StatusCode)
+	}
+	var body AuthResponse
+	json.NewDecoder(result.Body).Decode(&body)
+	if !validJWT(body.JWT) {
+		t.Fatal("a new JWT should be returned")
+	}
+	if !validatePass("newpass123", users["me@test.com"].PasswordHash) {
+		t.Fatal("password should be updated")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	handler, users, _ := newTestProfile(t)
+
+	if result := serveProfile(handler, "DELETE", "/me", `{"password": "wrong"}`); result.StatusCode != 401 {
+		t.Fatalf("Status code should be 401 but is %d", result.StatusCode)
+	}
+
+	result := serveProfile(handler, "DELETE", "/me", `{"password": "pass1234"}`)
+
+	if result.StatusCode != 204 {
+		t.Fatalf("Status code should be 204 but is %d", result.StatusCode)
+	}
+	if _, ok := users["me@test.com"]; ok {
+		t.Fatal("user should be deleted")
+	}
+}
+
+func TestProfilePasswordChecksAreThrottled(t *testing.T) {
+	handler, _, _ := newTestProfile(t)
+
+	for i := 0; i < MAX_ACCOUNT_FAILURES; i++ {
+		serveProfile(handler, "DELETE", "/me", `{"password": "wrong"}`)
+	}
+
+	result := serveProfile(handler, "POST", "/me/password", `{"current_password": "pass1234", "password": "newpass123"}`)
+	if result.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("the account should be locked even with the right password, got %d", result.StatusCode)
+	}
+}
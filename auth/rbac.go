@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const (
+	ROLE_OWNER  = "owner"
+	ROLE_ADMIN  = "admin"
+	ROLE_EDITOR = "editor"
+	ROLE_VIEWER = "viewer"
+)
+
+// Every role can do everything the roles below it can.
+var roleRanks = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_ADMIN:  3,
+	ROLE_OWNER:  4,
+}
+
+type Action string
+
+const (
+	ACTION_READ_TOGGLES   Action = "read toggles"
+	ACTION_WRITE_TOGGLES  Action = "write toggles"
+	ACTION_READ_MEMBERS   Action = "read members"
+	ACTION_MANAGE_MEMBERS Action = "manage members"
+	ACTION_MANAGE_KEYS    Action = "manage API keys"
+	ACTION_READ_AUDIT     Action = "read the audit log"
+)
+
+var requiredRoles = map[Action]string{
+	ACTION_READ_TOGGLES:   ROLE_VIEWER,
+	ACTION_WRITE_TOGGLES:  ROLE_EDITOR,
+	ACTION_READ_MEMBERS:   ROLE_VIEWER,
+	ACTION_MANAGE_MEMBERS: ROLE_ADMIN,
+	ACTION_MANAGE_KEYS:    ROLE_ADMIN,
+	ACTION_READ_AUDIT:     ROLE_ADMIN,
+}
+
+func isValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hasRole tells if role is at least as powerful as required.
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+func (p Principal) Can(action Action) bool {
+	required, ok := requiredRoles[action]
+	return ok && hasRole(p.Role, required)
+}
+
+// Authorize checks the caller's role in the organization the request acts on
+// allows the action, responding 403 when it doesn't. Handlers should return
+// right away when it's false.
+func Authorize(w http.ResponseWriter, req *http.Request, action Action) bool {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if !principal.Can(action) {
+		util.JsonError("Your role can't "+string(action), http.StatusForbidden, w)
+		return false
+	}
+	return true
+}
+
+// AuthorizeEnvironment checks the caller can change the toggles of the
+// environment, ACTION_WRITE_TOGGLES plus the role its restriction requires
+// if any and a key allowed in it, responding 403 when it can't.
+func AuthorizeEnvironment(w http.ResponseWriter, req *http.Request, environments EnvironmentRepository, environment string) bool {
+	if !Authorize(w, req, ACTION_WRITE_TOGGLES) {
+		return false
+	}
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if !principal.InEnvironment(environment) {
+		keyEnvironmentError(principal, w)
+		return false
+	}
+
+	required, err := environments.RequiredRole(req.Context(), principal.OrgId, environment)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if required != "" && !hasRole(principal.Role, required) {
+		util.JsonError(fmt.Sprintf("Only %s members and above can change %s", required, environment), http.StatusForbidden, w)
+		return false
+	}
+	return true
+}
+
+// keyEnvironmentError responds to API keys used out of their environment.
+func keyEnvironmentError(principal Principal, w http.ResponseWriter) {
+	util.JsonError("This key is restricted to the "+principal.Environment+" environment", http.StatusForbidden, w)
+}
+
+// AuthorizeReadEnvironment checks the caller can read the toggles of the
+// environment, responding 403 when it can't.
+func AuthorizeReadEnvironment(w http.ResponseWriter, req *http.Request, environment string) bool {
+	if !Authorize(w, req, ACTION_READ_TOGGLES) {
+		return false
+	}
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return false
+	}
+	if !principal.InEnvironment(environment) {
+		keyEnvironmentError(principal, w)
+		return false
+	}
+	return true
+}
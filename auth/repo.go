@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+
+	"myfeaturetoggles.com/toggles/tracing"
 )
 
 const USERS_TABLE_NAME = "users"
@@ -18,28 +20,108 @@ type repo struct {
 }
 
 type User struct {
-	Id           int64
-	Email        string
-	PasswordHash string
+	Id              int64
+	Email           string
+	PasswordHash    string
+	TokenGeneration int64
+	Admin           bool
+	EmailVerified   bool
+	DisplayName     string
+	// PendingEmail replaces Email once the user verifies it.
+	PendingEmail string
+	// ServiceOrgId is the organization owning the account when it's a
+	// service account.
+	ServiceOrgId int64
+}
+
+func (u User) IsServiceAccount() bool {
+	return u.ServiceOrgId != 0
 }
 
 type UserRepository interface {
 	Create(ctx context.Context, email string, passwordHash string) error
 	Get(ctx context.Context, email string) (User, error)
+	GetById(ctx context.Context, id int64) (User, error)
+	MarkVerified(ctx context.Context, userId int64) error
+	UpdatePassword(ctx context.Context, userId int64, passwordHash string) error
+	UpdateDisplayName(ctx context.Context, userId int64, displayName string) error
+	// SetPendingEmail keeps the email the user wants to change to until
+	// they verify it, the current email stays in use meanwhile.
+	SetPendingEmail(ctx context.Context, userId int64, email string) error
+	// ConfirmEmail makes the pending email the verified email of the user,
+	// sql.ErrNoRows when it isn't pending anymore.
+	ConfirmEmail(ctx context.Context, userId int64, email string) error
+	// Delete removes the user with the organizations only they belong to,
+	// service accounts included, their toggles in shared organizations are
+	// reassigned to an owner.
+	// It returns errLastOwner when a shared organization would be left
+	// without owner.
+	Delete(ctx context.Context, userId int64) error
 }
 
+var errLastOwner = errors.New("last owner of an organization with other members")
+
 func (r repo) Get(ctx context.Context, email string) (User, error) {
-	query := fmt.Sprintf("SELECT id, password_hash FROM %s WHERE email=$1;", USERS_TABLE_NAME)
+	ctx, span := tracing.Start(ctx, "auth.repo.Get")
+	defer span.Finish()
+
+	query := fmt.Sprintf(
+		"SELECT id, password_hash, token_generation, is_admin, email_verified, display_name, COALESCE(pending_email, '') "+
+			"FROM %s WHERE email=$1;",
+		USERS_TABLE_NAME,
+	)
 	row := r.dbConnection.QueryRowContext(ctx, query, email)
 	user := User{Email: email}
-	if err := row.Scan(&user.Id, &user.PasswordHash); err != nil {
+	err := row.Scan(
+		&user.Id,
+		&user.PasswordHash,
+		&user.TokenGeneration,
+		&user.Admin,
+		&user.EmailVerified,
+		&user.DisplayName,
+		&user.PendingEmail,
+	)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (r repo) GetById(ctx context.Context, id int64) (User, error) {
+	ctx, span := tracing.Start(ctx, "auth.repo.GetById")
+	defer span.Finish()
+
+	query := fmt.Sprintf(
+		"SELECT COALESCE(email, ''), password_hash, token_generation, is_admin, email_verified, display_name, "+
+			"COALESCE(pending_email, ''), service_org_id FROM %s WHERE id=$1;",
+		USERS_TABLE_NAME,
+	)
+	row := r.dbConnection.QueryRowContext(ctx, query, id)
+	user := User{Id: id}
+	var serviceOrgId sql.NullInt64
+	err := row.Scan(
+		&user.Email,
+		&user.PasswordHash,
+		&user.TokenGeneration,
+		&user.Admin,
+		&user.EmailVerified,
+		&user.DisplayName,
+		&user.PendingEmail,
+		&serviceOrgId,
+	)
+	if err != nil {
 		return user, err
 	}
+	user.ServiceOrgId = serviceOrgId.Int64
 
 	return user, nil
 }
 
 func (r repo) Create(ctx context.Context, email string, passwordHash string) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.Create")
+	defer span.Finish()
+
 	row := r.dbConnection.QueryRowContext(
 		ctx,
 		fmt.Sprintf("SELECT count(1) FROM %s WHERE email=$1", USERS_TABLE_NAME),
@@ -52,8 +134,205 @@ func (r repo) Create(ctx context.Context, email string, passwordHash string) err
 	if count == 1 {
 		return errors.New("User with email: " + email + " Already exist")
 	}
-	query := fmt.Sprintf("INSERT INTO %s (email, password_hash) VALUES ($1, $2);", USERS_TABLE_NAME)
-	_, err := r.dbConnection.ExecContext(ctx, query, email, passwordHash)
+
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("INSERT INTO %s (email, password_hash) VALUES ($1, $2) RETURNING id;", USERS_TABLE_NAME)
+	var userId int64
+	if err := tx.QueryRowContext(ctx, query, email, passwordHash).Scan(&userId); err != nil {
+		return err
+	}
+	// every user starts with a personal organization, the default one
+	orgId, err := insertOrg(ctx, tx, email, userId)
+	if err != nil {
+		return err
+	}
+	query = fmt.Sprintf("UPDATE %s SET default_org_id=$2 WHERE id=$1;", USERS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId, orgId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r repo) MarkVerified(ctx context.Context, userId int64) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.MarkVerified")
+	defer span.Finish()
+
+	query := fmt.Sprintf("UPDATE %s SET email_verified=true WHERE id=$1;", USERS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, userId)
+
+	return err
+}
+
+func (r repo) UpdatePassword(ctx context.Context, userId int64, passwordHash string) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.UpdatePassword")
+	defer span.Finish()
+
+	query := fmt.Sprintf("UPDATE %s SET password_hash=$2 WHERE id=$1;", USERS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, userId, passwordHash)
 
 	return err
 }
+
+func (r repo) UpdateDisplayName(ctx context.Context, userId int64, displayName string) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.UpdateDisplayName")
+	defer span.Finish()
+
+	query := fmt.Sprintf("UPDATE %s SET display_name=$2 WHERE id=$1;", USERS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, userId, displayName)
+
+	return err
+}
+
+func (r repo) SetPendingEmail(ctx context.Context, userId int64, email string) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.SetPendingEmail")
+	defer span.Finish()
+
+	query := fmt.Sprintf("UPDATE %s SET pending_email=$2 WHERE id=$1;", USERS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, userId, email)
+
+	return err
+}
+
+func (r repo) ConfirmEmail(ctx context.Context, userId int64, email string) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.ConfirmEmail")
+	defer span.Finish()
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET email=pending_email, pending_email=NULL, email_verified=true WHERE id=$1 AND pending_email=$2;",
+		USERS_TABLE_NAME,
+	)
+	res, err := r.dbConnection.ExecContext(ctx, query, userId, email)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r repo) Delete(ctx context.Context, userId int64) error {
+	ctx, span := tracing.Start(ctx, "auth.repo.Delete")
+	defer span.Finish()
+
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// service accounts don't count as other members, they go away with
+	// the organization
+	humans := fmt.Sprintf("o.user_id IN (SELECT id FROM %s WHERE service_org_id IS NULL)", USERS_TABLE_NAME)
+	query := fmt.Sprintf(
+		"SELECT count(1) FROM %[1]s m WHERE m.user_id=$1 AND m.role=$2 "+
+			"AND EXISTS (SELECT 1 FROM %[1]s o WHERE o.org_id=m.org_id AND o.user_id<>$1 AND %[2]s) "+
+			"AND NOT EXISTS (SELECT 1 FROM %[1]s o WHERE o.org_id=m.org_id AND o.user_id<>$1 AND o.role=$2);",
+		MEMBERSHIPS_TABLE_NAME,
+		humans,
+	)
+	var count int64
+	if err := tx.QueryRowContext(ctx, query, userId, ROLE_OWNER).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return errLastOwner
+	}
+
+	query = fmt.Sprintf(
+		"SELECT m.org_id FROM %[1]s m WHERE m.user_id=$1 "+
+			"AND NOT EXISTS (SELECT 1 FROM %[1]s o WHERE o.org_id=m.org_id AND o.user_id<>$1 AND %[2]s);",
+		MEMBERSHIPS_TABLE_NAME,
+		humans,
+	)
+	rows, err := tx.QueryContext(ctx, query, userId)
+	if err != nil {
+		return err
+	}
+	soleOrgs := []int64{}
+	for rows.Next() {
+		var orgId int64
+		if err := rows.Scan(&orgId); err != nil {
+			rows.Close()
+			return err
+		}
+		soleOrgs = append(soleOrgs, orgId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// organizations nobody else belongs to go away with everything in them
+	for _, orgId := range soleOrgs {
+		for _, table := range []string{
+			"toggles",
+			API_KEYS_TABLE_NAME,
+			INVITATIONS_TABLE_NAME,
+			ENVIRONMENT_RESTRICTIONS_TABLE_NAME,
+			MEMBERSHIPS_TABLE_NAME,
+		} {
+			query = fmt.Sprintf("DELETE FROM %s WHERE org_id=$1;", table)
+			if _, err := tx.ExecContext(ctx, query, orgId); err != nil {
+				return err
+			}
+		}
+		query = fmt.Sprintf("DELETE FROM %s WHERE service_org_id=$1;", USERS_TABLE_NAME)
+		if _, err := tx.ExecContext(ctx, query, orgId); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("UPDATE %s SET default_org_id=NULL WHERE default_org_id=$1;", USERS_TABLE_NAME)
+		if _, err := tx.ExecContext(ctx, query, orgId); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("DELETE FROM %s WHERE id=$1;", ORGANIZATIONS_TABLE_NAME)
+		if _, err := tx.ExecContext(ctx, query, orgId); err != nil {
+			return err
+		}
+	}
+
+	// toggles left in shared organizations now belong to one of their owners
+	query = fmt.Sprintf(
+		"UPDATE toggles t SET user_id=(SELECT min(m.user_id) FROM %s m WHERE m.org_id=t.org_id AND m.role=$2 AND m.user_id<>$1) "+
+			"WHERE t.user_id=$1;",
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	if _, err := tx.ExecContext(ctx, query, userId, ROLE_OWNER); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("DELETE FROM %s WHERE invited_by=$1;", INVITATIONS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+	for _, table := range []string{
+		API_KEYS_TABLE_NAME,
+		MEMBERSHIPS_TABLE_NAME,
+		USER_TOKENS_TABLE_NAME,
+		RECOVERY_CODES_TABLE_NAME,
+		OIDC_IDENTITIES_TABLE_NAME,
+		SESSIONS_TABLE_NAME,
+	} {
+		query = fmt.Sprintf("DELETE FROM %s WHERE user_id=$1;", table)
+		if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+			return err
+		}
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE id=$1;", USERS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+const REVOKED_TOKENS_TABLE_NAME = "revoked_tokens"
+
+// RevocationRepository persists revoked token ids and per-user token
+// generations so revocations survive restarts.
+type RevocationRepository interface {
+	RevokeToken(ctx context.Context, jti string, expiresAt int64) error
+	RevokedTokens(ctx context.Context, now int64) (map[string]int64, error)
+	IncrementGeneration(ctx context.Context, userId int64) (int64, error)
+	Generations(ctx context.Context) (map[int64]int64, error)
+}
+
+type revocationRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewRevocationRepo(dbConnection *sql.DB) RevocationRepository {
+	return revocationRepo{dbConnection}
+}
+
+func (r revocationRepo) RevokeToken(ctx context.Context, jti string, expiresAt int64) error {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;",
+		REVOKED_TOKENS_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(ctx, query, jti, expiresAt)
+
+	return err
+}
+
+func (r revocationRepo) RevokedTokens(ctx context.Context, now int64) (map[string]int64, error) {
+	query := fmt.Sprintf("SELECT jti, expires_at FROM %s WHERE expires_at > $1;", REVOKED_TOKENS_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string]int64{}
+	for rows.Next() {
+		var jti string
+		var expiresAt int64
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return nil, err
+		}
+		result[jti] = expiresAt
+	}
+
+	return result, rows.Err()
+}
+
+func (r revocationRepo) IncrementGeneration(ctx context.Context, userId int64) (int64, error) {
+	query := fmt.Sprintf(
+		"UPDATE %s SET token_generation = token_generation + 1 WHERE id=$1 RETURNING token_generation;",
+		USERS_TABLE_NAME,
+	)
+	var generation int64
+	err := r.dbConnection.QueryRowContext(ctx, query, userId).Scan(&generation)
+
+	return generation, err
+}
+
+func (r revocationRepo) Generations(ctx context.Context) (map[int64]int64, error) {
+	query := fmt.Sprintf("SELECT id, token_generation FROM %s WHERE token_generation > 0;", USERS_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int64]int64{}
+	for rows.Next() {
+		var userId, generation int64
+		if err := rows.Scan(&userId, &generation); err != nil {
+			return nil, err
+		}
+		result[userId] = generation
+	}
+
+	return result, rows.Err()
+}
+
+// RevocationList keeps revoked tokens in memory so AuthMiddleware can check
+// them without a database round trip. Writes go through to the repository,
+// revocations made by other instances are picked up by Watch.
+type RevocationList struct {
+	repo        RevocationRepository
+	mu          sync.RWMutex
+	tokens      map[string]int64
+	generations map[int64]int64
+}
+
+func NewRevocationList(ctx context.Context, repo RevocationRepository) (*RevocationList, error) {
+	l := &RevocationList{repo: repo}
+	if err := l.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Refresh reloads the revocations from the repository, where every instance
+// writes them.
+func (l *RevocationList) Refresh(ctx context.Context) error {
+	tokens, err := l.repo.RevokedTokens(ctx, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	generations, err := l.repo.Generations(ctx)
+	if err != nil {
+		return err
+	}
+
+	// revocations are never undone, what was revoked here meanwhile stays
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	for jti, exp := range l.tokens {
+		if _, ok := tokens[jti]; !ok && exp > now {
+			tokens[jti] = exp
+		}
+	}
+	for userId, generation := range l.generations {
+		if generation > generations[userId] {
+			generations[userId] = generation
+		}
+	}
+	l.tokens = tokens
+	l.generations = generations
+
+	return nil
+}
+
+// Watch refreshes the list every interval until ctx is done, so logouts on
+// other instances apply here within the interval.
+func (l *RevocationList) Watch(ctx context.Context, interval time.Duration, logger *logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Refresh(ctx); err != nil && ctx.Err() == nil {
+				logger.Error("error refreshing revoked tokens", "error", err)
+			}
+		}
+	}
+}
+
+// Revoke invalidates a single token until it expires.
+func (l *RevocationList) Revoke(ctx context.Context, payload jwtPayload) error {
+	expiresAt := payload.Iat + EXPIRATION_TIME_SECONDS
+	if err := l.repo.RevokeToken(ctx, payload.Jti, expiresAt); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	for jti, exp := range l.tokens {
+		if exp < now {
+			delete(l.tokens, jti)
+		}
+	}
+	l.tokens[payload.Jti] = expiresAt
+
+	return nil
+}
+
+// RevokeUser invalidates every token issued to the user so far.
+func (l *RevocationList) RevokeUser(ctx context.Context, userId int64) error {
+	generation, err := l.repo.IncrementGeneration(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generations[userId] = generation
+
+	return nil
+}
+
+func (l *RevocationList) IsRevoked(payload jwtPayload) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if payload.Gen < l.generations[payload.UserId] {
+		return true
+	}
+	if payload.Jti == "" {
+		return false
+	}
+	_, revoked := l.tokens[payload.Jti]
+
+	return revoked
+}
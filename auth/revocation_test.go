@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+// fakeRevocationRepo is shared by the lists of several instances.
+type fakeRevocationRepo struct {
+	tokens      map[string]int64
+	generations map[int64]int64
+}
+
+func (r *fakeRevocationRepo) RevokeToken(ctx context.Context, jti string, expiresAt int64) error {
+	if r.tokens == nil {
+		r.tokens = map[string]int64{}
+	}
+	r.tokens[jti] = expiresAt
+	return nil
+}
+
+func (r *fakeRevocationRepo) RevokedTokens(ctx context.Context, now int64) (map[string]int64, error) {
+	tokens := map[string]int64{}
+	for jti, expiresAt := range r.tokens {
+		if expiresAt > now {
+			tokens[jti] = expiresAt
+		}
+	}
+	return tokens, nil
+}
+
+func (r *fakeRevocationRepo) IncrementGeneration(ctx context.Context, userId int64) (int64, error) {
+	if r.generations == nil {
+		r.generations = map[int64]int64{}
+	}
+	r.generations[userId]++
+	return r.generations[userId], nil
+}
+
+func (r *fakeRevocationRepo) Generations(ctx context.Context) (map[int64]int64, error) {
+	generations := map[int64]int64{}
+	for userId, generation := range r.generations {
+		generations[userId] = generation
+	}
+	return generations, nil
+}
+
+func newTestRevocationList(t *testing.T) *RevocationList {
+	list, err := NewRevocationList(context.Background(), &fakeRevocationRepo{})
+	check(err, t)
+	return list
+}
+
+func TestRevokeToken(t *testing.T) {
+	list := newTestRevocationList(t)
+	revoked := jwtPayload{UserId: 10, Iat: time.Now().Unix(), Jti: "revoked"}
+	other := jwtPayload{UserId: 10, Iat: time.Now().Unix(), Jti: "other"}
+
+	check(list.Revoke(context.Background(), revoked), t)
+
+	if !list.IsRevoked(revoked) {
+		t.Fatal("token should be revoked")
+	}
+	if list.IsRevoked(other) {
+		t.Fatal("other tokens of the user should still be valid")
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	list := newTestRevocationList(t)
+	old := jwtPayload{UserId: 10, Jti: "a", Gen: 0}
+	otherUser := jwtPayload{UserId: 11, Jti: "b", Gen: 0}
+
+	check(list.RevokeUser(context.Background(), 10), t)
+
+	if !list.IsRevoked(old) {
+		t.Fatal("tokens issued before the revocation should be revoked")
+	}
+	if list.IsRevoked(jwtPayload{UserId: 10, Jti: "c", Gen: 1}) {
+		t.Fatal("tokens of the new generation should be valid")
+	}
+	if list.IsRevoked(otherUser) {
+		t.Fatal("tokens of other users should be valid")
+	}
+}
+
+func TestRevocationsOfOtherInstances(t *testing.T) {
+	repo := &fakeRevocationRepo{}
+	here, err := NewRevocationList(context.Background(), repo)
+	check(err, t)
+	there, err := NewRevocationList(context.Background(), repo)
+	check(err, t)
+	token := jwtPayload{UserId: 10, Iat: time.Now().Unix(), Jti: "token"}
+
+	check(there.Revoke(context.Background(), token), t)
+	check(there.RevokeUser(context.Background(), 20), t)
+	if here.IsRevoked(token) {
+		t.Fatal("revocations of other instances should only apply once refreshed")
+	}
+
+	check(here.Refresh(context.Background()), t)
+	if !here.IsRevoked(token) || !here.IsRevoked(jwtPayload{UserId: 20}) {
+		t.Fatal("revocations of other instances should apply after a refresh")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	list := newTestRevocationList(t)
+	token := generateJWT(User{Id: 10})
+	handler := NewLogoutHandler(context.Background(), logging.Default(), list)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/auth/logout", nil)
+	payload, err := decodeJWTPayload(strings.Split(token, ".")[1])
+	check(err, t)
+	principal := Principal{UserId: 10, Scopes: sessionScopes(false), SessionId: payload.Jti}
+
+	handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+
+	if recorder.Result().StatusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", recorder.Result().StatusCode)
+	}
+	if !list.IsRevoked(payload) {
+		t.Fatal("token should be revoked after logout")
+	}
+}
+
+func TestRevokeSessionsRequiresAdmin(t *testing.T) {
+	handler := RequireScope(SCOPE_ADMIN)(
+		NewRevokeSessionsHandler(context.Background(), logging.Default(), newTestRevocationList(t)),
+	)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/revoke-sessions", strings.NewReader(`{"user_id": 11}`))
+	principal := Principal{UserId: 10, Scopes: sessionScopes(false)}
+
+	handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+
+	result := recorder.Result()
+	defer result.Body.Close()
+	if result.StatusCode != 403 {
+		t.Fatalf("Status code should be 403 but is %d", result.StatusCode)
+	}
+
+	var ups map[string]string
+	json.NewDecoder(result.Body).Decode(&ups)
+	if ups["error"] != "Missing scope: admin" {
+		t.Fatalf("error should name the missing scope but is '%s'", ups["error"])
+	}
+}
+
+func TestForgedTokenWithoutMiddleware(t *testing.T) {
+	handler := RequireScope(SCOPE_ADMIN)(
+		NewRevokeSessionsHandler(context.Background(), logging.Default(), newTestRevocationList(t)),
+	)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/revoke-sessions", strings.NewReader(`{"user_id": 11}`))
+	forged := encodeJWT(jwtPayload{UserId: 10, Admin: true})
+	request.Header.Add("Authorization", forged[:strings.LastIndex(forged, ".")]+".forged")
+
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code == 200 {
+		t.Fatal("claims of an unverified token shouldn't grant any scope")
+	}
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/router"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const (
+	SCOPE_TOGGLES_READ  = "toggles:read"
+	SCOPE_TOGGLES_WRITE = "toggles:write"
+	SCOPE_AUDIT_READ    = "audit:read"
+	// SCOPE_ADMIN grants every other scope.
+	SCOPE_ADMIN = "admin"
+)
+
+var knownScopes = []string{SCOPE_TOGGLES_READ, SCOPE_TOGGLES_WRITE, SCOPE_AUDIT_READ, SCOPE_ADMIN}
+
+// Scopes a key gets when it's created without explicit ones.
+var defaultKeyScopes = map[string][]string{
+	SERVER_KEY: {SCOPE_TOGGLES_READ, SCOPE_TOGGLES_WRITE},
+	CLIENT_KEY: {SCOPE_TOGGLES_READ},
+}
+
+// Client keys end up in browsers and apps, so they can never write.
+var allowedClientScopes = []string{SCOPE_TOGGLES_READ}
+
+func sessionScopes(admin bool) []string {
+	scopes := []string{SCOPE_TOGGLES_READ, SCOPE_TOGGLES_WRITE, SCOPE_AUDIT_READ}
+	if admin {
+		scopes = append(scopes, SCOPE_ADMIN)
+	}
+	return scopes
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return containsScope(p.Scopes, scope) || containsScope(p.Scopes, SCOPE_ADMIN)
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func parseScopes(scopes string) []string {
+	return strings.Fields(scopes)
+}
+
+func formatScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// RequireScope rejects callers whose credentials lack the scope.
+func RequireScope(scope string) router.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !checkScope(scope, w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScopes needs the read scope for safe methods and the write scope for
+// everything else.
+func RequireScopes(read string, write string) router.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				scope = read
+			}
+			if !checkScope(scope, w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func checkScope(scope string, w http.ResponseWriter, r *http.Request) bool {
+	principal, err := GetPrincipal(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if !principal.HasScope(scope) {
+		util.JsonError("Missing scope: "+scope, http.StatusForbidden, w)
+		return false
+	}
+	return true
+}
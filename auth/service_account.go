@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ServiceAccount is a non human member of an organization meant for
+// automation. It's stored as a user without email nor usable password, so it
+// can only authenticate with its API keys and never goes through the login,
+// verification or password reset flows.
+type ServiceAccount struct {
+	Id    int64  `json:"id"`
+	OrgId int64  `json:"org_id"`
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+}
+
+type ServiceAccountRepository interface {
+	Create(ctx context.Context, orgId int64, name string, role string) (int64, error)
+	GetAll(ctx context.Context, orgId int64) ([]ServiceAccount, error)
+	// Get returns sql.ErrNoRows when the organization doesn't own the account.
+	Get(ctx context.Context, orgId int64, id int64) (ServiceAccount, error)
+}
+
+type serviceAccountRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewServiceAccountRepo(dbConnection *sql.DB) ServiceAccountRepository {
+	return serviceAccountRepo{dbConnection}
+}
+
+func (r serviceAccountRepo) Create(ctx context.Context, orgId int64, name string, role string) (int64, error) {
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// an empty hash never matches a password
+	query := fmt.Sprintf(
+		"INSERT INTO %s (password_hash, display_name, service_org_id) VALUES ('', $1, $2) RETURNING id;",
+		USERS_TABLE_NAME,
+	)
+	var id int64
+	if err := tx.QueryRowContext(ctx, query, name, orgId).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (org_id, user_id, role) VALUES ($1, $2, $3);", MEMBERSHIPS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, orgId, id, role); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func (r serviceAccountRepo) GetAll(ctx context.Context, orgId int64) ([]ServiceAccount, error) {
+	query := fmt.Sprintf(
+		"SELECT u.id, u.service_org_id, u.display_name, m.role FROM %s u "+
+			"JOIN %s m ON m.user_id = u.id AND m.org_id = u.service_org_id WHERE u.service_org_id=$1 ORDER BY u.id;",
+		USERS_TABLE_NAME,
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	rows, err := r.dbConnection.QueryContext(ctx, query, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []ServiceAccount{}
+	for rows.Next() {
+		var account ServiceAccount
+		if err := rows.Scan(&account.Id, &account.OrgId, &account.Name, &account.Role); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (r serviceAccountRepo) Get(ctx context.Context, orgId int64, id int64) (ServiceAccount, error) {
+	query := fmt.Sprintf(
+		"SELECT u.id, u.service_org_id, u.display_name, m.role FROM %s u "+
+			"JOIN %s m ON m.user_id = u.id AND m.org_id = u.service_org_id WHERE u.service_org_id=$1 AND u.id=$2;",
+		USERS_TABLE_NAME,
+		MEMBERSHIPS_TABLE_NAME,
+	)
+	var account ServiceAccount
+	err := r.dbConnection.QueryRowContext(ctx, query, orgId, id).Scan(&account.Id, &account.OrgId, &account.Name, &account.Role)
+
+	return account, err
+}
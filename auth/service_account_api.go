@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type createServiceAccountBody struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type serviceAccountHandler struct {
+	repo     ServiceAccountRepository
+	orgs     OrgRepository
+	users    UserRepository
+	keys     APIKeyRepository
+	recorder audit.Recorder
+	logger   *logging.Logger
+}
+
+func NewServiceAccountHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo ServiceAccountRepository,
+	orgs OrgRepository,
+	users UserRepository,
+	keys APIKeyRepository,
+	recorder audit.Recorder,
+) http.Handler {
+	return serviceAccountHandler{repo, orgs, users, keys, recorder, logger}
+}
+
+// serviceAccountHandler manages the service accounts of the organization:
+// GET and POST /orgs/service-accounts, PUT /orgs/service-accounts/<id> to
+// change its role, DELETE /orgs/service-accounts/<id> and
+// POST /orgs/service-accounts/<id>/keys to create its credentials.
+func (h serviceAccountHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage service accounts", http.StatusForbidden, w)
+		return
+	}
+	if !Authorize(w, req, ACTION_MANAGE_MEMBERS) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/orgs/service-accounts")
+	if path == "" {
+		h.serveCollection(principal, w, req)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/keys"), 10, 64)
+	if err != nil {
+		util.JsonError("A valid id is required: /orgs/service-accounts/<id>", http.StatusBadRequest, w)
+		return
+	}
+	account, err := h.repo.Get(req.Context(), principal.OrgId, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	target := fmt.Sprintf("service_account:%d", account.Id)
+
+	switch {
+	case req.Method == "PUT" && !strings.HasSuffix(path, "/keys"):
+		defer req.Body.Close()
+		var body setRoleBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if !checkServiceAccountRole(principal, body.Role, w) {
+			return
+		}
+
+		_, err = h.orgs.SetRole(req.Context(), principal.OrgId, account.Id, body.Role)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		h.record(req, principal, "service_account.update", target)
+		account.Role = body.Role
+		util.JsonResponse(account, http.StatusOK, w)
+	case req.Method == "DELETE" && !strings.HasSuffix(path, "/keys"):
+		// its keys go away with it and its toggles are reassigned to an owner
+		err = h.users.Delete(req.Context(), account.Id)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		h.record(req, principal, "service_account.delete", target)
+		w.WriteHeader(http.StatusOK)
+	case req.Method == "POST" && strings.HasSuffix(path, "/keys"):
+		if !Authorize(w, req, ACTION_MANAGE_KEYS) {
+			return
+		}
+		owner := APIKey{UserId: account.Id, OrgId: principal.OrgId, ServiceAccount: true}
+		if key, ok := createAPIKey(h.keys, principal, owner, w, req); ok {
+			h.record(req, principal, "service_account.key_create", fmt.Sprintf("%s/api_key:%d", target, key.Id))
+		}
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+func (h serviceAccountHandler) serveCollection(principal Principal, w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		accounts, err := h.repo.GetAll(req.Context(), principal.OrgId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(accounts, http.StatusOK, w)
+	case "POST":
+		defer req.Body.Close()
+		var body createServiceAccountBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Name == "" || utf8.RuneCountInString(body.Name) > MAX_DISPLAY_NAME_LENGTH {
+			util.JsonError(fmt.Sprintf("'name' is required, up to %d characters", MAX_DISPLAY_NAME_LENGTH), http.StatusBadRequest, w)
+			return
+		}
+		if body.Role == "" {
+			body.Role = ROLE_VIEWER
+		}
+		if !checkServiceAccountRole(principal, body.Role, w) {
+			return
+		}
+
+		id, err := h.repo.Create(req.Context(), principal.OrgId, body.Name, body.Role)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		h.record(req, principal, "service_account.create", fmt.Sprintf("service_account:%d", id))
+		util.JsonResponse(ServiceAccount{id, principal.OrgId, body.Name, body.Role}, http.StatusCreated, w)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+func (h serviceAccountHandler) record(req *http.Request, principal Principal, action string, target string) {
+	if err := h.recorder.Record(req.Context(), AuditEvent(req, principal, action, target)); err != nil {
+		util.RequestLogger(h.logger, req).Error("error recording audit event", "error", err)
+	}
+}
+
+// checkServiceAccountRole keeps ownership, and with it the organization
+// itself, in the hands of people.
+func checkServiceAccountRole(principal Principal, role string, w http.ResponseWriter) bool {
+	if role == ROLE_OWNER {
+		util.JsonError("Service accounts can't be owners", http.StatusBadRequest, w)
+		return false
+	}
+	return checkAssignableRole(principal, role, w)
+}
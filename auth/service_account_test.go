@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeServiceAccountRepo struct {
+	orgs   fakeOrgRepo
+	owners map[int64]int64
+	names  map[int64]string
+}
+
+func (r fakeServiceAccountRepo) Create(ctx context.Context, orgId int64, name string, role string) (int64, error) {
+	id := int64(200 + len(r.owners))
+	r.owners[id] = orgId
+	r.names[id] = name
+	r.orgs.members[orgId][id] = role
+	return id, nil
+}
+
+func (r fakeServiceAccountRepo) GetAll(ctx context.Context, orgId int64) ([]ServiceAccount, error) {
+	accounts := []ServiceAccount{}
+	for id := range r.owners {
+		if account, err := r.Get(ctx, orgId, id); err == nil {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (r fakeServiceAccountRepo) Get(ctx context.Context, orgId int64, id int64) (ServiceAccount, error) {
+	if r.owners[id] != orgId {
+		return ServiceAccount{}, sql.ErrNoRows
+	}
+	return ServiceAccount{id, orgId, r.names[id], r.orgs.members[orgId][id]}, nil
+}
+
+type serviceAccountTest struct {
+	handler http.Handler
+	orgs    fakeOrgRepo
+	keys    fakeAPIKeyRepo
+	events  *[]audit.Event
+}
+
+func newServiceAccountTest() serviceAccountTest {
+	orgs := newTestOrgRepo()
+	repo := fakeServiceAccountRepo{orgs, map[int64]int64{}, map[int64]string{}}
+	keys := fakeAPIKeyRepo{map[string]APIKey{}}
+	events := &[]audit.Event{}
+	handler := NewServiceAccountHandler(context.Background(), logging.Default(), repo, orgs, fakeUsers{}, keys, fakeRecorder{events})
+
+	return serviceAccountTest{handler, orgs, keys, events}
+}
+
+func (s serviceAccountTest) serve(method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, asOrgAdmin(httptest.NewRequest(method, path, strings.NewReader(body))))
+	return recorder
+}
+
+func (s serviceAccountTest) create(t *testing.T) ServiceAccount {
+	recorder := s.serve("POST", "/orgs/service-accounts", `{"name": "ci", "role": "editor"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Status code should be 201 but is %d", recorder.Code)
+	}
+	var account ServiceAccount
+	json.NewDecoder(recorder.Body).Decode(&account)
+	return account
+}
+
+func TestCreateServiceAccount(t *testing.T) {
+	test := newServiceAccountTest()
+
+	if recorder := test.serve("POST", "/orgs/service-accounts", `{"name": "ci", "role": "owner"}`); recorder.Code != 400 {
+		t.Fatalf("service accounts shouldn't be owners, got %d", recorder.Code)
+	}
+	account := test.create(t)
+
+	if account.OrgId != 1 || account.Role != ROLE_EDITOR || test.orgs.members[1][account.Id] != ROLE_EDITOR {
+		t.Fatalf("service account should be an editor of the organization, got %+v", account)
+	}
+	if len(*test.events) != 1 || (*test.events)[0].ActorType != audit.ACTOR_USER || (*test.events)[0].ActorId != 10 {
+		t.Fatal("creation should be audited with the admin as actor")
+	}
+
+	var accounts []ServiceAccount
+	json.NewDecoder(test.serve("GET", "/orgs/service-accounts", "").Body).Decode(&accounts)
+	if len(accounts) != 1 {
+		t.Fatal("service account should be listed")
+	}
+}
+
+func TestServiceAccountOfOtherOrganization(t *testing.T) {
+	test := newServiceAccountTest()
+	account := test.create(t)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("PUT", fmt.Sprintf("/orgs/service-accounts/%d", account.Id), strings.NewReader(`{"role": "viewer"}`))
+	principal := Principal{UserId: 11, OrgId: 3, Role: ROLE_OWNER, Scopes: sessionScopes(false)}
+
+	test.handler.ServeHTTP(recorder, request.WithContext(WithPrincipal(request.Context(), principal)))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Status code should be 404 but is %d", recorder.Code)
+	}
+}
+
+func TestServiceAccountKeys(t *testing.T) {
+	test := newServiceAccountTest()
+	account := test.create(t)
+
+	recorder := test.serve("POST", fmt.Sprintf("/orgs/service-accounts/%d/keys", account.Id), `{"name": "deploy", "type": "server"}`)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Status code should be 201 but is %d", recorder.Code)
+	}
+	var created CreateAPIKeyResponse
+	json.NewDecoder(recorder.Body).Decode(&created)
+	if created.UserId != account.Id || !created.ServiceAccount {
+		t.Fatalf("key should belong to the service account, got %+v", created.APIKey)
+	}
+
+	var principal Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = GetPrincipal(r)
+	})
+	request := httptest.NewRequest("GET", "/toggles", nil)
+	request.Header.Add("Authorization", created.Key)
+	AuthMiddleware(nil, nil, test.keys, test.orgs)(next).ServeHTTP(httptest.NewRecorder(), request)
+
+	if !principal.ServiceAccount || principal.UserId != account.Id || principal.Role != ROLE_EDITOR {
+		t.Fatalf("key should act as the service account with its role, got %+v", principal)
+	}
+}
+
+func TestServiceAccountsCantStartSessions(t *testing.T) {
+	_, err := newTestSessions(t).Start(context.Background(), User{Id: 200, ServiceOrgId: 1}, httptest.NewRequest("POST", "/auth", nil))
+
+	if err == nil {
+		t.Fatal("service accounts should only use API keys")
+	}
+}
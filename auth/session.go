@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const SESSIONS_TABLE_NAME = "sessions"
+
+// SESSION_TOUCH_INTERVAL limits how often the last use of a session is written.
+const SESSION_TOUCH_INTERVAL = time.Minute
+
+// Session is a token issued to a user, its id is the jti of the token.
+type Session struct {
+	Id         string    `json:"id"`
+	UserId     int64     `json:"-"`
+	Generation int64     `json:"-"`
+	IssuedAt   int64     `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+	// Revoked is only set by ByUser, the other sessions are valid.
+	Revoked bool `json:"-"`
+}
+
+type SessionRepository interface {
+	Create(ctx context.Context, session Session) error
+	// Active returns the sessions of the user issued after the given unix
+	// time that weren't revoked, one by one or all together.
+	Active(ctx context.Context, userId int64, issuedAfter int64) ([]Session, error)
+	// ByUser returns every stored session of the user, revoked and expired
+	// ones included.
+	ByUser(ctx context.Context, userId int64) ([]Session, error)
+	Touch(ctx context.Context, id string, ip string) error
+}
+
+type sessionRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewSessionRepo(dbConnection *sql.DB) SessionRepository {
+	return sessionRepo{dbConnection}
+}
+
+func (r sessionRepo) Create(ctx context.Context, session Session) error {
+	// expired sessions of the user aren't needed anymore
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id=$1 AND issued_at < $2;", SESSIONS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, session.UserId, session.IssuedAt-EXPIRATION_TIME_SECONDS)
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(
+		"INSERT INTO %s (id, user_id, generation, issued_at, user_agent, ip) VALUES ($1, $2, $3, $4, $5, $6);",
+		SESSIONS_TABLE_NAME,
+	)
+	_, err = r.dbConnection.ExecContext(
+		ctx,
+		query,
+		session.Id,
+		session.UserId,
+		session.Generation,
+		session.IssuedAt,
+		session.UserAgent,
+		session.IP,
+	)
+
+	return err
+}
+
+func (r sessionRepo) Active(ctx context.Context, userId int64, issuedAfter int64) ([]Session, error) {
+	query := fmt.Sprintf(
+		"SELECT s.id, s.issued_at, s.user_agent, s.ip, s.created_at, s.last_used_at FROM %s s JOIN %s u ON u.id = s.user_id "+
+			"WHERE s.user_id=$1 AND s.issued_at > $2 AND s.generation >= u.token_generation "+
+			"AND NOT EXISTS (SELECT 1 FROM %s r WHERE r.jti = s.id) ORDER BY s.last_used_at DESC;",
+		SESSIONS_TABLE_NAME,
+		USERS_TABLE_NAME,
+		REVOKED_TOKENS_TABLE_NAME,
+	)
+	rows, err := r.dbConnection.QueryContext(ctx, query, userId, issuedAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{UserId: userId}
+		err := rows.Scan(
+			&session.Id,
+			&session.IssuedAt,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (r sessionRepo) ByUser(ctx context.Context, userId int64) ([]Session, error) {
+	query := fmt.Sprintf(
+		"SELECT s.id, s.issued_at, s.user_agent, s.ip, s.created_at, s.last_used_at, "+
+			"s.generation < u.token_generation OR EXISTS (SELECT 1 FROM %s r WHERE r.jti = s.id) "+
+			"FROM %s s JOIN %s u ON u.id = s.user_id WHERE s.user_id=$1 ORDER BY s.created_at DESC;",
+		REVOKED_TOKENS_TABLE_NAME,
+		SESSIONS_TABLE_NAME,
+		USERS_TABLE_NAME,
+	)
+	rows, err := r.dbConnection.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{UserId: userId}
+		err := rows.Scan(
+			&session.Id,
+			&session.IssuedAt,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Revoked,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (r sessionRepo) Touch(ctx context.Context, id string, ip string) error {
+	query := fmt.Sprintf("UPDATE %s SET last_used_at=now(), ip=$2 WHERE id=$1;", SESSIONS_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, id, ip)
+
+	return err
+}
+
+// Sessions issues the tokens of the users and keeps track of where they are
+// used. Revoking goes through the RevocationList so AuthMiddleware rejects
+// revoked sessions without a database round trip.
+type Sessions struct {
+	repo        SessionRepository
+	revocations *RevocationList
+	mu          sync.Mutex
+	touched     map[string]time.Time
+	now         func() time.Time
+}
+
+func NewSessions(repo SessionRepository, revocations *RevocationList) *Sessions {
+	return &Sessions{repo: repo, revocations: revocations, touched: map[string]time.Time{}, now: time.Now}
+}
+
+var errServiceAccountSession = errors.New("service accounts can only use API keys")
+
+// Start issues a token for the user and records the client it was issued to.
+func (s *Sessions) Start(ctx context.Context, user User, req *http.Request) (string, error) {
+	if user.IsServiceAccount() {
+		return "", errServiceAccountSession
+	}
+	payload := newJWTPayload(user)
+	err := s.repo.Create(ctx, Session{
+		Id:         payload.Jti,
+		UserId:     user.Id,
+		Generation: payload.Gen,
+		IssuedAt:   payload.Iat,
+		UserAgent:  truncate(req.UserAgent(), 250),
+		IP:         clientIP(req),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return encodeJWT(payload), nil
+}
+
+// Touch records the use of a session, at most once per SESSION_TOUCH_INTERVAL.
+func (s *Sessions) Touch(ctx context.Context, payload jwtPayload, req *http.Request) error {
+	if payload.Jti == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	now := s.now()
+	if now.Sub(s.touched[payload.Jti]) < SESSION_TOUCH_INTERVAL {
+		s.mu.Unlock()
+		return nil
+	}
+	for jti, touched := range s.touched {
+		if now.Sub(touched) >= SESSION_TOUCH_INTERVAL {
+			delete(s.touched, jti)
+		}
+	}
+	s.touched[payload.Jti] = now
+	s.mu.Unlock()
+
+	return s.repo.Touch(ctx, payload.Jti, clientIP(req))
+}
+
+func (s *Sessions) Active(ctx context.Context, userId int64) ([]Session, error) {
+	return s.repo.Active(ctx, userId, s.now().Unix()-EXPIRATION_TIME_SECONDS)
+}
+
+// All returns every session of the user still stored, revoked and expired
+// ones included.
+func (s *Sessions) All(ctx context.Context, userId int64) ([]Session, error) {
+	return s.repo.ByUser(ctx, userId)
+}
+
+// Revoke logs out one of the active sessions of the user, it returns false
+// when there's no such session.
+func (s *Sessions) Revoke(ctx context.Context, userId int64, id string) (bool, error) {
+	sessions, err := s.Active(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if session.Id == id {
+			payload := jwtPayload{UserId: userId, Jti: id, Iat: session.IssuedAt}
+			return true, s.revocations.Revoke(ctx, payload)
+		}
+	}
+
+	return false, nil
+}
+
+// truncate cuts the value to at most length bytes without splitting a
+// character, invalid UTF-8 is dropped since the database rejects it.
+func truncate(value string, length int) string {
+	value = strings.ToValidUTF8(value, "")
+	if len(value) <= length {
+		return value
+	}
+	for length > 0 && !utf8.RuneStart(value[length]) {
+		length--
+	}
+	return value[:length]
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type sessionHandler struct {
+	sessions *Sessions
+	logger   *logging.Logger
+}
+
+func NewSessionHandler(ctx context.Context, logger *logging.Logger, sessions *Sessions) http.Handler {
+	return sessionHandler{sessions, logger}
+}
+
+// sessionHandler handles GET /me/sessions to list where the caller is logged
+// in and DELETE /me/sessions/<id> to log out one of those sessions.
+func (h sessionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage sessions", http.StatusForbidden, w)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		sessions, err := h.sessions.Active(req.Context(), principal.UserId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Id == principal.SessionId
+		}
+		util.JsonResponse(sessions, http.StatusOK, w)
+	case "DELETE":
+		id := strings.TrimPrefix(req.URL.Path, "/me/sessions/")
+		if id == "" || id == req.URL.Path {
+			util.JsonError("A valid id is required: /me/sessions/<id>", http.StatusBadRequest, w)
+			return
+		}
+
+		found, err := h.sessions.Revoke(req.Context(), principal.UserId, id)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
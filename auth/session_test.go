@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeSessionRepo struct {
+	sessions map[string]Session
+	touches  *int
+}
+
+func newFakeSessionRepo() fakeSessionRepo {
+	return fakeSessionRepo{map[string]Session{}, new(int)}
+}
+
+func (r fakeSessionRepo) Create(ctx context.Context, session Session) error {
+	session.CreatedAt = time.Unix(session.IssuedAt, 0)
+	session.LastUsedAt = session.CreatedAt
+	r.sessions[session.Id] = session
+	return nil
+}
+
+func (r fakeSessionRepo) Active(ctx context.Context, userId int64, issuedAfter int64) ([]Session, error) {
+	sessions := []Session{}
+	for _, session := range r.sessions {
+		if session.UserId == userId && session.IssuedAt > issuedAfter {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (r fakeSessionRepo) ByUser(ctx context.Context, userId int64) ([]Session, error) {
+	sessions := []Session{}
+	for _, session := range r.sessions {
+		if session.UserId == userId {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (r fakeSessionRepo) Touch(ctx context.Context, id string, ip string) error {
+	*r.touches++
+	session := r.sessions[id]
+	session.IP = ip
+	r.sessions[id] = session
+	return nil
+}
+
+func newTestSessions(t *testing.T) *Sessions {
+	return NewSessions(newFakeSessionRepo(), newTestRevocationList(t))
+}
+
+func startSession(t *testing.T, sessions *Sessions, userAgent string) string {
+	request := httptest.NewRequest("POST", "/auth", nil)
+	request.Header.Set("User-Agent", userAgent)
+	token, err := sessions.Start(context.Background(), User{Id: 10}, request)
+	check(err, t)
+	return token
+}
+
+func TestStartSession(t *testing.T) {
+	repo := newFakeSessionRepo()
+	sessions := NewSessions(repo, newTestRevocationList(t))
+
+	token := startSession(t, sessions, "test-agent")
+
+	payload, err := parseJWT(token)
+	check(err, t)
+	session, ok := repo.sessions[payload.Jti]
+	if !ok {
+		t.Fatal("session should be recorded with the jti of the token")
+	}
+	if session.UserId != 10 || session.UserAgent != "test-agent" || session.IP != "192.0.2.1" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	repo := newFakeSessionRepo()
+	sessions := NewSessions(repo, newTestRevocationList(t))
+	now := time.Now()
+	sessions.now = func() time.Time { return now }
+	payload := jwtPayload{UserId: 10, Jti: "jti"}
+	request := httptest.NewRequest("GET", "/toggles", nil)
+
+	check(sessions.Touch(context.Background(), payload, request), t)
+	check(sessions.Touch(context.Background(), payload, request), t)
+	if *repo.touches != 1 {
+		t.Fatalf("session should be written once per interval, got %d writes", *repo.touches)
+	}
+
+	now = now.Add(SESSION_TOUCH_INTERVAL)
+	check(sessions.Touch(context.Background(), payload, request), t)
+	if *repo.touches != 2 {
+		t.Fatal("session should be written again after the interval")
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	revocations := newTestRevocationList(t)
+	sessions := NewSessions(newFakeSessionRepo(), revocations)
+	current := startSession(t, sessions, "laptop")
+	other := startSession(t, sessions, "phone")
+	handler := AuthMiddleware(revocations, sessions, fakeAPIKeyRepo{}, newTestOrgRepo())(
+		NewSessionHandler(context.Background(), logging.Default(), sessions),
+	)
+	serve := func(method string, path string, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Add("Authorization", token)
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := serve("GET", "/me/sessions", current)
+
+	var listed []Session
+	json.NewDecoder(recorder.Body).Decode(&listed)
+	if recorder.Code != http.StatusOK || len(listed) != 2 {
+		t.Fatalf("both sessions should be listed, got %d %+v", recorder.Code, listed)
+	}
+	var otherId string
+	for _, session := range listed {
+		if session.Current != (session.UserAgent == "laptop") {
+			t.Fatal("only the session of the request should be current")
+		}
+		if session.UserAgent == "phone" {
+			otherId = session.Id
+		}
+	}
+
+	if recorder := serve("DELETE", "/me/sessions/unknown", current); recorder.Code != http.StatusNotFound {
+		t.Fatalf("Status code should be 404 but is %d", recorder.Code)
+	}
+	if recorder := serve("DELETE", "/me/sessions/"+otherId, current); recorder.Code != http.StatusOK {
+		t.Fatalf("Status code should be 200 but is %d", recorder.Code)
+	}
+	if recorder := serve("GET", "/me/sessions", other); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked session should be rejected, got %d", recorder.Code)
+	}
+	if recorder := serve("GET", "/me/sessions", current); recorder.Code != http.StatusOK {
+		t.Fatal("other sessions should stay valid")
+	}
+}
+
+func TestTruncateKeepsCharacters(t *testing.T) {
+	cases := []struct {
+		value    string
+		length   int
+		expected string
+	}{
+		{"curl", 250, "curl"},
+		{"abcdef", 3, "abc"},
+		{"añb", 2, "a"},
+		{"añb", 3, "añ"},
+		{"日本", 4, "日"},
+		{"a\xffb", 250, "ab"},
+	}
+
+	for _, c := range cases {
+		if result := truncate(c.value, c.length); result != c.expected || !utf8.ValidString(result) {
+			t.Errorf("truncate(%q, %d) should be %q but is %q", c.value, c.length, c.expected, result)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"myfeaturetoggles.com/toggles/audit"
+)
+
+const (
+	MAX_ACCOUNT_FAILURES = 5
+	MAX_IP_FAILURES      = 20
+	// Failures older than this are forgotten.
+	FAILURE_WINDOW = 15 * time.Minute
+	// Every lockout of the same key lasts twice the previous one.
+	BASE_LOCKOUT = 5 * time.Minute
+	MAX_LOCKOUT  = 24 * time.Hour
+	// Forgotten keys are dropped at most this often.
+	PRUNE_INTERVAL = time.Minute
+	// Accounts and IPs tracked at once, each, past it the oldest are dropped.
+	MAX_TRACKED_KEYS = 100000
+)
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// LoginThrottle tracks failed logins per account and per IP, locking them
+// out for a while after too many failures.
+type LoginThrottle struct {
+	recorder audit.Recorder
+	mu       sync.Mutex
+	accounts map[string]*attempts
+	ips      map[string]*attempts
+	now      func() time.Time
+	maxKeys  int
+	pruned   time.Time
+}
+
+func NewLoginThrottle(recorder audit.Recorder) *LoginThrottle {
+	return &LoginThrottle{
+		recorder: recorder,
+		accounts: map[string]*attempts{},
+		ips:      map[string]*attempts{},
+		now:      time.Now,
+		maxKeys:  MAX_TRACKED_KEYS,
+	}
+}
+
+// LockedFor returns how long the account or the IP remain locked, zero when
+// the login can be attempted.
+func (t *LoginThrottle) LockedFor(email string, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	wait := time.Duration(0)
+	for _, a := range []*attempts{t.accounts[email], t.ips[ip]} {
+		if a != nil && a.lockedUntil.After(now) && a.lockedUntil.Sub(now) > wait {
+			wait = a.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Failure records a failed login, the error comes from recording the audit
+// event of a lockout, the failure is tracked anyway.
+func (t *LoginThrottle) Failure(ctx context.Context, email string, ip string) error {
+	t.mu.Lock()
+	now := t.now()
+	if now.Sub(t.pruned) > PRUNE_INTERVAL {
+		t.prune(t.accounts, now)
+		t.prune(t.ips, now)
+		t.pruned = now
+	}
+	accountLocked := t.fail(t.accounts, email, MAX_ACCOUNT_FAILURES, now)
+	ipLocked := t.fail(t.ips, ip, MAX_IP_FAILURES, now)
+	t.mu.Unlock()
+
+	if accountLocked {
+		if err := t.recordLockout(ctx, AccountTarget(email), ip); err != nil {
+			return err
+		}
+	}
+	if ipLocked {
+		return t.recordLockout(ctx, "ip:"+ip, ip)
+	}
+	return nil
+}
+
+// Success forgets the failures of the account, the ones of the IP are kept
+// so an attacker can't reset them with an account of their own.
+func (t *LoginThrottle) Success(email string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.accounts, email)
+}
+
+// fail records a failure for the key and tells if it got locked out because of it.
+func (t *LoginThrottle) fail(all map[string]*attempts, key string, max int, now time.Time) bool {
+	a, ok := all[key]
+	if !ok {
+		if len(all) >= t.maxKeys {
+			t.prune(all, now)
+			t.evict(all, now)
+		}
+		a = &attempts{}
+		all[key] = a
+	}
+	if now.Sub(a.lastFailure) > FAILURE_WINDOW {
+		a.failures = 0
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if a.failures < max {
+		return false
+	}
+
+	lockout := BASE_LOCKOUT << a.lockouts
+	if lockout > MAX_LOCKOUT || lockout <= 0 {
+		lockout = MAX_LOCKOUT
+	}
+	a.lockouts++
+	a.failures = 0
+	a.lockedUntil = now.Add(lockout)
+
+	return true
+}
+
+// prune drops keys that aren't locked and whose failures are forgotten
+// already, so the maps don't grow forever.
+func (t *LoginThrottle) prune(all map[string]*attempts, now time.Time) {
+	for key, a := range all {
+		if a.lockedUntil.Before(now) && now.Sub(a.lastFailure) > MAX_LOCKOUT {
+			delete(all, key)
+		}
+	}
+}
+
+// evict makes room for a key when pruning wasn't enough, dropping the key
+// with the oldest failure, a locked one only when every key is locked.
+func (t *LoginThrottle) evict(all map[string]*attempts, now time.Time) {
+	for len(all) >= t.maxKeys {
+		var oldest string
+		var oldestAttempts *attempts
+		for key, a := range all {
+			if oldestAttempts == nil || isOlder(a, oldestAttempts, now) {
+				oldest, oldestAttempts = key, a
+			}
+		}
+		delete(all, oldest)
+	}
+}
+
+// isOlder tells if a should be evicted before b.
+func isOlder(a *attempts, b *attempts, now time.Time) bool {
+	aLocked, bLocked := a.lockedUntil.After(now), b.lockedUntil.After(now)
+	if aLocked != bLocked {
+		return bLocked
+	}
+	return a.lastFailure.Before(b.lastFailure)
+}
+
+// AccountTarget is the audit target of events about the account with the
+// email, like its lockouts.
+func AccountTarget(email string) string {
+	return "account:" + email
+}
+
+func (t *LoginThrottle) recordLockout(ctx context.Context, target string, ip string) error {
+	return t.recorder.Record(ctx, audit.Event{
+		ActorType: audit.ACTOR_ANONYMOUS,
+		Action:    "auth.lockout",
+		Target:    target,
+		IP:        ip,
+	})
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeRecorder struct {
+	events *[]audit.Event
+}
+
+func (r fakeRecorder) Record(ctx context.Context, event audit.Event) error {
+	*r.events = append(*r.events, event)
+	return nil
+}
+
+func newTestThrottle() *LoginThrottle {
+	return NewLoginThrottle(fakeRecorder{&[]audit.Event{}})
+}
+
+func authAs(handler http.Handler, email string, password string, ip string) *http.Response {
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"email": "` + email + `", "password": "` + password + `"}`)
+	request := httptest.NewRequest("POST", "/auth", body)
+	request.RemoteAddr = ip + ":1234"
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Result()
+}
+
+func TestAuthFailuresAreUniform(t *testing.T) {
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"test@test.com": User{Id: 10, Email: "test@test.com", PasswordHash: passwordHash}}
+	handler := NewAuthUpHandler(context.Background(), logging.Default(), users, testPasswords, newFakeTwoFactorRepo(), newTestThrottle(), newTestSessions(t))
+
+	wrongPassword := authAs(handler, "test@test.com", "wrong", "10.0.0.1")
+	unknownEmail := authAs(handler, "unknown@test.com", "wrong", "10.0.0.1")
+
+	var wrongBody, unknownBody map[string]string
+	json.NewDecoder(wrongPassword.Body).Decode(&wrongBody)
+	json.NewDecoder(unknownEmail.Body).Decode(&unknownBody)
+	if wrongPassword.StatusCode != 401 || unknownEmail.StatusCode != 401 || wrongBody["error"] != unknownBody["error"] {
+		t.Fatalf("unknown emails and wrong passwords should get the same answer: %v, %v", wrongBody, unknownBody)
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	users := fakeUsers{"test@test.com": User{Id: 10, Email: "test@test.com", PasswordHash: passwordHash, EmailVerified: true}}
+	var events []audit.Event
+	throttle := NewLoginThrottle(fakeRecorder{&events})
+	handler := NewAuthUpHandler(context.Background(), logging.Default(), users, testPasswords, newFakeTwoFactorRepo(), throttle, newTestSessions(t))
+
+	for i := 0; i < MAX_ACCOUNT_FAILURES; i++ {
+		authAs(handler, "test@test.com", "wrong", "10.0.0.1")
+	}
+
+	result := authAs(handler, "test@test.com", "pass1234", "10.0.0.2")
+	if result.StatusCode != http.StatusTooManyRequests || result.Header.Get("Retry-After") == "" {
+		t.Fatalf("account should be locked even with the right password, got %d", result.StatusCode)
+	}
+	if len(events) != 1 || events[0].Action != "auth.lockout" || events[0].Target != "account:test@test.com" {
+		t.Fatalf("the lockout should be audited, got %v", events)
+	}
+
+	throttle.now = func() time.Time { return time.Now().Add(BASE_LOCKOUT) }
+	if result := authAs(handler, "test@test.com", "pass1234", "10.0.0.2"); result.StatusCode != 200 {
+		t.Fatalf("account should be unlocked after the lockout, got %d", result.StatusCode)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	throttle := newTestThrottle()
+	for i := 0; i < MAX_IP_FAILURES; i++ {
+		throttle.Failure(context.Background(), "user"+string(rune('a'+i))+"@test.com", "10.0.0.1")
+	}
+
+	if throttle.LockedFor("other@test.com", "10.0.0.1") == 0 {
+		t.Fatal("IP should be locked")
+	}
+	if throttle.LockedFor("other@test.com", "10.0.0.2") != 0 {
+		t.Fatal("other IPs shouldn't be locked")
+	}
+}
+
+func TestProgressiveLockout(t *testing.T) {
+	throttle := newTestThrottle()
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+
+	for lockout := 0; lockout < 3; lockout++ {
+		for i := 0; i < MAX_ACCOUNT_FAILURES; i++ {
+			throttle.Failure(context.Background(), "test@test.com", "10.0.0.1")
+		}
+		expected := BASE_LOCKOUT << lockout
+		if wait := throttle.LockedFor("test@test.com", ""); wait != expected {
+			t.Fatalf("lockout %d should last %s but lasts %s", lockout+1, expected, wait)
+		}
+		now = now.Add(expected)
+	}
+}
+
+func TestThrottleForgetsOldFailures(t *testing.T) {
+	throttle := newTestThrottle()
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+
+	throttle.Failure(context.Background(), "old@test.com", "10.0.0.1")
+	now = now.Add(MAX_LOCKOUT + time.Minute)
+	throttle.Failure(context.Background(), "new@test.com", "10.0.0.2")
+
+	if _, ok := throttle.accounts["old@test.com"]; ok || len(throttle.ips) != 1 {
+		t.Fatalf("old failures should be dropped, tracking %d accounts and %d IPs", len(throttle.accounts), len(throttle.ips))
+	}
+}
+
+func TestThrottleIsBounded(t *testing.T) {
+	throttle := newTestThrottle()
+	throttle.maxKeys = 3
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+
+	for i := 0; i < MAX_ACCOUNT_FAILURES; i++ {
+		throttle.Failure(context.Background(), "locked@test.com", "10.0.0.1")
+	}
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		throttle.Failure(context.Background(), "user"+string(rune('a'+i))+"@test.com", "10.0.0.1")
+	}
+
+	if len(throttle.accounts) != 3 {
+		t.Fatalf("should track at most 3 accounts but tracks %d", len(throttle.accounts))
+	}
+	if throttle.LockedFor("locked@test.com", "") == 0 {
+		t.Fatal("locked accounts should be kept over the ones that only failed")
+	}
+}
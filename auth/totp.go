@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const TOTP_ISSUER = "My feature toggles"
+const TOTP_PERIOD_SECONDS = 30
+const TOTP_DIGITS = 6
+
+// Codes from the previous and next period are accepted too, to allow for
+// clock drift between the server and the user's device.
+const TOTP_SKEW = 1
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32NoPadding.EncodeToString(b)
+}
+
+func totpURI(secret string, email string) string {
+	label := url.PathEscape(TOTP_ISSUER + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTP_ISSUER)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(TOTP_PERIOD_SECONDS))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD_SECONDS
+}
+
+// totpCode implements the HOTP algorithm of RFC 4226 for the given step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%mod), nil
+}
+
+// matchTOTP returns the step the code belongs to, or -1 if it doesn't match
+// any step within the allowed skew.
+func matchTOTP(secret string, code string, now time.Time) int64 {
+	current := totpStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return -1
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+// generateRecoveryCodes returns the plain codes, shown once to the user, and
+// their hashes to store.
+func generateRecoveryCodes(n int) ([]string, []string) {
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes
+}
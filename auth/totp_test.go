@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238, truncated to 6 digits
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range cases {
+		code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		check(err, t)
+		if code != expected {
+			t.Errorf("code at %d should be %s but is %s", unix, expected, code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := generateTOTPSecret()
+	now := time.Now()
+	previous, _ := totpCode(secret, totpStep(now)-1)
+	old, _ := totpCode(secret, totpStep(now)-3)
+
+	if matchTOTP(secret, previous, now) != totpStep(now)-1 {
+		t.Fatal("codes of the previous period should be accepted")
+	}
+	if matchTOTP(secret, old, now) != -1 {
+		t.Fatal("old codes should be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("SECRET", "ibado@test.com")
+
+	expected := "otpauth://totp/My%20feature%20toggles:ibado@test.com?"
+	if !strings.HasPrefix(uri, expected) || !strings.Contains(uri, "secret=SECRET") {
+		t.Fatalf("unexpected otpauth URI: %s", uri)
+	}
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(generateTOTPSecret()); err != nil {
+		t.Fatal("secrets should be base32 encoded")
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const RECOVERY_CODES_TABLE_NAME = "recovery_codes"
+const RECOVERY_CODES_COUNT = 10
+
+type TwoFactor struct {
+	Email   string
+	Secret  string
+	Enabled bool
+}
+
+type TwoFactorRepository interface {
+	Get(ctx context.Context, userId int64) (TwoFactor, error)
+	// SetSecret stores a secret that's not used until Enable is called.
+	SetSecret(ctx context.Context, userId int64, secret string) error
+	Enable(ctx context.Context, userId int64, recoveryCodeHashes []string) error
+	Disable(ctx context.Context, userId int64) error
+	// UseStep records a TOTP step as used, it's false if that step or a
+	// later one was used before, so codes can't be replayed.
+	UseStep(ctx context.Context, userId int64, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userId int64, codeHash string) (bool, error)
+}
+
+type twoFactorRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewTwoFactorRepo(dbConnection *sql.DB) TwoFactorRepository {
+	return twoFactorRepo{dbConnection}
+}
+
+func (r twoFactorRepo) Get(ctx context.Context, userId int64) (TwoFactor, error) {
+	query := fmt.Sprintf("SELECT email, totp_secret, totp_enabled FROM %s WHERE id=$1;", USERS_TABLE_NAME)
+	var tf TwoFactor
+	var secret sql.NullString
+	err := r.dbConnection.QueryRowContext(ctx, query, userId).Scan(&tf.Email, &secret, &tf.Enabled)
+	tf.Secret = secret.String
+
+	return tf, err
+}
+
+func (r twoFactorRepo) SetSecret(ctx context.Context, userId int64, secret string) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET totp_secret=$2, totp_enabled=false, totp_last_step=0 WHERE id=$1;",
+		USERS_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(ctx, query, userId, secret)
+
+	return err
+}
+
+func (r twoFactorRepo) Enable(ctx context.Context, userId int64, recoveryCodeHashes []string) error {
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET totp_enabled=true WHERE id=$1;", USERS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userId, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r twoFactorRepo) Disable(ctx context.Context, userId int64) error {
+	tx, err := r.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET totp_secret=NULL, totp_enabled=false WHERE id=$1;", USERS_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userId, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userId int64, hashes []string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id=$1;", RECOVERY_CODES_TABLE_NAME)
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (user_id, code_hash) VALUES ($1, $2);", RECOVERY_CODES_TABLE_NAME)
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, query, userId, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r twoFactorRepo) UseStep(ctx context.Context, userId int64, step int64) (bool, error) {
+	query := fmt.Sprintf("UPDATE %s SET totp_last_step=$2 WHERE id=$1 AND totp_last_step < $2;", USERS_TABLE_NAME)
+	res, err := r.dbConnection.ExecContext(ctx, query, userId, step)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
+
+func (r twoFactorRepo) UseRecoveryCode(ctx context.Context, userId int64, codeHash string) (bool, error) {
+	query := fmt.Sprintf(
+		"UPDATE %s SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;",
+		RECOVERY_CODES_TABLE_NAME,
+	)
+	res, err := r.dbConnection.ExecContext(ctx, query, userId, codeHash)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+
+	return count > 0, err
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func verifySecondFactor(ctx context.Context, repo TwoFactorRepository, userId int64, secret string, code string) (bool, error) {
+	if step := matchTOTP(secret, code, time.Now()); step >= 0 {
+		return repo.UseStep(ctx, userId, step)
+	}
+
+	return repo.UseRecoveryCode(ctx, userId, hashToken(code))
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type codeBody struct {
+	Code string `json:"code"`
+}
+
+type EnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type twoFactorHandler struct {
+	repo   TwoFactorRepository
+	logger *logging.Logger
+}
+
+func NewTwoFactorHandler(ctx context.Context, logger *logging.Logger, repo TwoFactorRepository) http.Handler {
+	return twoFactorHandler{repo, logger}
+}
+
+// twoFactorHandler handles the enrollment of the caller: POST /me/2fa creates
+// a new secret, POST /me/2fa/confirm enables it once the user proves their
+// device generates valid codes and DELETE /me/2fa disables it.
+func (h twoFactorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if principal.IsAPIKey() {
+		util.JsonError("API keys can't manage two-factor authentication", http.StatusForbidden, w)
+		return
+	}
+
+	tf, err := h.repo.Get(req.Context(), principal.UserId)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/me/2fa":
+		if tf.Enabled {
+			util.JsonError("Two-factor authentication is already enabled", http.StatusConflict, w)
+			return
+		}
+
+		secret := generateTOTPSecret()
+		err = h.repo.SetSecret(req.Context(), principal.UserId, secret)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(EnrollmentResponse{secret, totpURI(secret, tf.Email)}, http.StatusOK, w)
+	case req.Method == http.MethodPost && req.URL.Path == "/me/2fa/confirm":
+		if tf.Enabled {
+			util.JsonError("Two-factor authentication is already enabled", http.StatusConflict, w)
+			return
+		}
+		if tf.Secret == "" {
+			util.JsonError("Start the enrollment with POST /me/2fa first", http.StatusBadRequest, w)
+			return
+		}
+
+		code, ok := decodeCode(req, w)
+		if !ok {
+			return
+		}
+		step := matchTOTP(tf.Secret, code, time.Now())
+		if step < 0 {
+			util.JsonError("Invalid code", http.StatusBadRequest, w)
+			return
+		}
+		_, err = h.repo.UseStep(req.Context(), principal.UserId, step)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		codes, hashes := generateRecoveryCodes(RECOVERY_CODES_COUNT)
+		err = h.repo.Enable(req.Context(), principal.UserId, hashes)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.JsonResponse(RecoveryCodesResponse{codes}, http.StatusOK, w)
+	case req.Method == http.MethodDelete && req.URL.Path == "/me/2fa":
+		if !tf.Enabled {
+			util.JsonError("Two-factor authentication is not enabled", http.StatusConflict, w)
+			return
+		}
+
+		code, ok := decodeCode(req, w)
+		if !ok {
+			return
+		}
+		valid, err := verifySecondFactor(req.Context(), h.repo, principal.UserId, tf.Secret, code)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		if !valid {
+			util.JsonError("Invalid code", http.StatusBadRequest, w)
+			return
+		}
+
+		err = h.repo.Disable(req.Context(), principal.UserId)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	}
+}
+
+func decodeCode(req *http.Request, w http.ResponseWriter) (string, bool) {
+	defer req.Body.Close()
+	var body codeBody
+	json.NewDecoder(req.Body).Decode(&body)
+	if body.Code == "" {
+		util.JsonError("'code' is required", http.StatusBadRequest, w)
+		return "", false
+	}
+	return body.Code, true
+}
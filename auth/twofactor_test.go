@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type fakeTwoFactorRepo struct {
+	tf            *TwoFactor
+	lastStep      *int64
+	recoveryCodes map[string]bool
+}
+
+func newFakeTwoFactorRepo() fakeTwoFactorRepo {
+	var lastStep int64
+	return fakeTwoFactorRepo{&TwoFactor{Email: "test@test.com"}, &lastStep, map[string]bool{}}
+}
+
+func (r fakeTwoFactorRepo) Get(ctx context.Context, userId int64) (TwoFactor, error) {
+	return *r.tf, nil
+}
+
+func (r fakeTwoFactorRepo) SetSecret(ctx context.Context, userId int64, secret string) error {
+	r.tf.Secret = secret
+	return nil
+}
+
+func (r fakeTwoFactorRepo) Enable(ctx context.Context, userId int64, recoveryCodeHashes []string) error {
+	r.tf.Enabled = true
+	for _, hash := range recoveryCodeHashes {
+		r.recoveryCodes[hash] = true
+	}
+	return nil
+}
+
+func (r fakeTwoFactorRepo) Disable(ctx context.Context, userId int64) error {
+	*r.tf = TwoFactor{Email: r.tf.Email}
+	return nil
+}
+
+func (r fakeTwoFactorRepo) UseStep(ctx context.Context, userId int64, step int64) (bool, error) {
+	if step <= *r.lastStep {
+		return false, nil
+	}
+	*r.lastStep = step
+	return true, nil
+}
+
+func (r fakeTwoFactorRepo) UseRecoveryCode(ctx context.Context, userId int64, codeHash string) (bool, error) {
+	unused := r.recoveryCodes[codeHash]
+	delete(r.recoveryCodes, codeHash)
+	return unused, nil
+}
+
+func serveTwoFactor(repo TwoFactorRepository, method string, path string, body string) *httptest.ResponseRecorder {
+	handler := NewTwoFactorHandler(context.Background(), logging.Default(), repo)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request = request.WithContext(WithPrincipal(request.Context(), Principal{UserId: 10}))
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func authWithCode(t *testing.T, repo TwoFactorRepository, code string) int {
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	user := User{Id: 10, Email: "test@test.com", PasswordHash: passwordHash, EmailVerified: true}
+	handler := NewAuthUpHandler(context.Background(), logging.Default(), fakeRepo{user}, testPasswords, repo, newTestThrottle(), newTestSessions(t))
+	body := `{"email": "test@test.com", "password": "pass1234", "code": "` + code + `"}`
+
+	return post(handler, "/auth", body)
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	repo := newFakeTwoFactorRepo()
+
+	recorder := serveTwoFactor(repo, "POST", "/me/2fa", "")
+	var enrollment EnrollmentResponse
+	json.NewDecoder(recorder.Result().Body).Decode(&enrollment)
+	if enrollment.Secret == "" || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Fatal("enrollment should return the secret and its otpauth URI")
+	}
+
+	if serveTwoFactor(repo, "POST", "/me/2fa/confirm", `{"code": "000000"}`).Code != 400 {
+		t.Fatal("invalid codes shouldn't enable 2FA")
+	}
+
+	code, _ := totpCode(enrollment.Secret, totpStep(time.Now()))
+	recorder = serveTwoFactor(repo, "POST", "/me/2fa/confirm", `{"code": "`+code+`"}`)
+	var recovery RecoveryCodesResponse
+	json.NewDecoder(recorder.Result().Body).Decode(&recovery)
+	if recorder.Code != 200 || len(recovery.RecoveryCodes) != RECOVERY_CODES_COUNT {
+		t.Fatalf("confirming should enable 2FA and return the recovery codes, got %d", recorder.Code)
+	}
+	if !repo.tf.Enabled {
+		t.Fatal("2FA should be enabled")
+	}
+}
+
+func TestAuthWithTwoFactor(t *testing.T) {
+	repo := newFakeTwoFactorRepo()
+	repo.SetSecret(context.Background(), 10, generateTOTPSecret())
+	codes, hashes := generateRecoveryCodes(2)
+	repo.Enable(context.Background(), 10, hashes)
+	code, _ := totpCode(repo.tf.Secret, totpStep(time.Now()))
+
+	if statusCode := authWithCode(t, repo, ""); statusCode != 401 {
+		t.Fatalf("a code should be required, got %d", statusCode)
+	}
+	if statusCode := authWithCode(t, repo, code); statusCode != 200 {
+		t.Fatalf("valid codes should be accepted, got %d", statusCode)
+	}
+	if statusCode := authWithCode(t, repo, code); statusCode != 401 {
+		t.Fatalf("codes shouldn't be accepted twice, got %d", statusCode)
+	}
+	if statusCode := authWithCode(t, repo, codes[0]); statusCode != 200 {
+		t.Fatalf("recovery codes should be accepted, got %d", statusCode)
+	}
+	if statusCode := authWithCode(t, repo, codes[0]); statusCode != 401 {
+		t.Fatalf("recovery codes should be single use, got %d", statusCode)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"myfeaturetoggles.com/toggles/mail"
+)
+
+const USER_TOKENS_TABLE_NAME = "user_tokens"
+
+const (
+	PURPOSE_VERIFY_EMAIL   = "verify_email"
+	PURPOSE_RESET_PASSWORD = "reset_password"
+	PURPOSE_CHANGE_EMAIL   = "change_email"
+)
+
+var tokenExpirations = map[string]time.Duration{
+	PURPOSE_VERIFY_EMAIL:   24 * time.Hour,
+	PURPOSE_RESET_PASSWORD: time.Hour,
+	PURPOSE_CHANGE_EMAIL:   24 * time.Hour,
+}
+
+// TokenRepository stores the hashes of single-use tokens mailed to users,
+// with the email they were mailed to.
+type TokenRepository interface {
+	Create(ctx context.Context, userId int64, email string, purpose string, tokenHash string) error
+	// Use marks the token as used and returns its user and email,
+	// sql.ErrNoRows when it doesn't exist, was already used or expired.
+	Use(ctx context.Context, purpose string, tokenHash string) (int64, string, error)
+}
+
+type tokenRepo struct {
+	dbConnection *sql.DB
+}
+
+func NewTokenRepo(dbConnection *sql.DB) TokenRepository {
+	return tokenRepo{dbConnection}
+}
+
+func (r tokenRepo) Create(ctx context.Context, userId int64, email string, purpose string, tokenHash string) error {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (token_hash, user_id, email, purpose, expires_at) "+
+			"VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second');",
+		USER_TOKENS_TABLE_NAME,
+	)
+	_, err := r.dbConnection.ExecContext(ctx, query, tokenHash, userId, email, purpose, tokenExpirations[purpose].Seconds())
+
+	return err
+}
+
+func (r tokenRepo) Use(ctx context.Context, purpose string, tokenHash string) (int64, string, error) {
+	query := fmt.Sprintf(
+		"UPDATE %s SET used_at=now() WHERE token_hash=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > now() "+
+			"RETURNING user_id, email;",
+		USER_TOKENS_TABLE_NAME,
+	)
+	var userId int64
+	var email sql.NullString
+	err := r.dbConnection.QueryRowContext(ctx, query, tokenHash, purpose).Scan(&userId, &email)
+
+	return userId, email.String, err
+}
+
+// useToken consumes the token and returns its user. Tokens mailed to an email
+// the user doesn't have anymore are rejected with sql.ErrNoRows, like used or
+// expired ones, so they can't verify or take over the new email.
+func useToken(ctx context.Context, tokens TokenRepository, users UserRepository, purpose string, token string) (User, error) {
+	userId, email, err := tokens.Use(ctx, purpose, hashToken(token))
+	if err != nil {
+		return User{}, err
+	}
+	user, err := users.GetById(ctx, userId)
+	if err != nil {
+		return User{}, err
+	}
+	if email == "" || email != user.Email {
+		return User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+// useEmailChangeToken consumes the token mailed to a pending email and
+// returns its user and the email, sql.ErrNoRows when the user changed their
+// mind meanwhile.
+func useEmailChangeToken(ctx context.Context, tokens TokenRepository, users UserRepository, token string) (User, string, error) {
+	userId, email, err := tokens.Use(ctx, PURPOSE_CHANGE_EMAIL, hashToken(token))
+	if err != nil {
+		return User{}, "", err
+	}
+	user, err := users.GetById(ctx, userId)
+	if err != nil {
+		return User{}, "", err
+	}
+	if email == "" || email != user.PendingEmail {
+		return User{}, "", sql.ErrNoRows
+	}
+
+	return user, email, nil
+}
+
+// AccountMailer mails the tokens users need to verify their email, change
+// it or reset their password.
+type AccountMailer struct {
+	tokens  TokenRepository
+	mailer  mail.Mailer
+	baseURL string
+}
+
+func NewAccountMailer(tokens TokenRepository, mailer mail.Mailer, baseURL string) *AccountMailer {
+	return &AccountMailer{tokens, mailer, baseURL}
+}
+
+func (m *AccountMailer) SendVerification(ctx context.Context, user User) error {
+	return m.send(ctx, user.Id, user.Email, PURPOSE_VERIFY_EMAIL, "Verify your email", "verify your email", "/verify-email")
+}
+
+func (m *AccountMailer) SendPasswordReset(ctx context.Context, user User) error {
+	return m.send(ctx, user.Id, user.Email, PURPOSE_RESET_PASSWORD, "Reset your password", "choose a new password", "/password-reset/confirm")
+}
+
+// SendEmailChange mails the token to confirm the new email to it.
+func (m *AccountMailer) SendEmailChange(ctx context.Context, user User, email string) error {
+	return m.send(ctx, user.Id, email, PURPOSE_CHANGE_EMAIL, "Confirm your new email", "confirm your new email", "/verify-email/change")
+}
+
+// NotifyEmailChange warns the current email of the user, so its owner
+// notices changes they didn't ask for.
+func (m *AccountMailer) NotifyEmailChange(ctx context.Context, user User, email string) error {
+	return m.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Your email is being changed",
+		Body: fmt.Sprintf(
+			"A change of the email of your account to %s was requested, it applies once confirmed from that address.\n\n"+
+				"If it wasn't you, change your password.",
+			email,
+		),
+	})
+}
+
+func (m *AccountMailer) send(ctx context.Context, userId int64, email string, purpose string, subject string, action string, path string) error {
+	token, hash := newToken()
+	if err := m.tokens.Create(ctx, userId, email, purpose, hash); err != nil {
+		return err
+	}
+
+	return m.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: subject,
+		Body: fmt.Sprintf(
+			"Use this token to %s, it expires in %s:\n\n%s\n\nPOST %s%s",
+			action,
+			tokenExpirations[purpose],
+			token,
+			m.baseURL,
+			path,
+		),
+	})
+}
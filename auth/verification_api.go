@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+type tokenBody struct {
+	Token string `json:"token"`
+}
+
+type emailBody struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type verifyEmailHandler struct {
+	repo   UserRepository
+	tokens TokenRepository
+	mailer *AccountMailer
+	logger *logging.Logger
+}
+
+type passwordResetHandler struct {
+	repo        UserRepository
+	passwords   *Passwords
+	tokens      TokenRepository
+	mailer      *AccountMailer
+	revocations *RevocationList
+	logger      *logging.Logger
+}
+
+func NewVerifyEmailHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo UserRepository,
+	tokens TokenRepository,
+	mailer *AccountMailer,
+) http.Handler {
+	return verifyEmailHandler{repo, tokens, mailer, logger}
+}
+
+func NewPasswordResetHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	repo UserRepository,
+	passwords *Passwords,
+	tokens TokenRepository,
+	mailer *AccountMailer,
+	revocations *RevocationList,
+) http.Handler {
+	return passwordResetHandler{repo, passwords, tokens, mailer, revocations, logger}
+}
+
+// verifyEmailHandler handles POST /verify-email with the mailed token,
+// POST /verify-email/resend to get a new one and POST /verify-email/change
+// with the token mailed to a new email to switch to it.
+func (h verifyEmailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer req.Body.Close()
+
+	switch req.URL.Path {
+	case "/verify-email":
+		var body tokenBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Token == "" {
+			util.JsonError("'token' is required", http.StatusBadRequest, w)
+			return
+		}
+
+		user, err := useToken(req.Context(), h.tokens, h.repo, PURPOSE_VERIFY_EMAIL, body.Token)
+		if errors.Is(err, sql.ErrNoRows) {
+			util.JsonError("Invalid or expired token", http.StatusBadRequest, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		err = h.repo.MarkVerified(req.Context(), user.Id)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "/verify-email/change":
+		var body tokenBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Token == "" {
+			util.JsonError("'token' is required", http.StatusBadRequest, w)
+			return
+		}
+
+		user, email, err := useEmailChangeToken(req.Context(), h.tokens, h.repo, body.Token)
+		if errors.Is(err, sql.ErrNoRows) {
+			util.JsonError("Invalid or expired token", http.StatusBadRequest, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		// someone else may have signed up with it since it was requested
+		_, err = h.repo.Get(req.Context(), email)
+		if err == nil {
+			util.JsonError("Email already in use", http.StatusConflict, w)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		err = h.repo.ConfirmEmail(req.Context(), user.Id, email)
+		if errors.Is(err, sql.ErrNoRows) {
+			util.JsonError("Invalid or expired token", http.StatusBadRequest, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		util.RequestLogger(h.logger, req).Info("email changed", "user_id", user.Id)
+		w.WriteHeader(http.StatusOK)
+	case "/verify-email/resend":
+		var body emailBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Email == "" {
+			util.JsonError("'email' is required", http.StatusBadRequest, w)
+			return
+		}
+
+		// always answer the same so this can't be used to find out which emails exist
+		user, err := h.repo.Get(req.Context(), body.Email)
+		if err == nil && !user.EmailVerified {
+			err = h.mailer.SendVerification(req.Context(), user)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			util.RequestLogger(h.logger, req).Error("error sending verification mail", "error", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// passwordResetHandler handles POST /password-reset to mail a reset token and
+// POST /password-reset/confirm to set the new password with it.
+func (h passwordResetHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer req.Body.Close()
+
+	switch req.URL.Path {
+	case "/password-reset":
+		var body emailBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Email == "" {
+			util.JsonError("'email' is required", http.StatusBadRequest, w)
+			return
+		}
+
+		// always answer the same so this can't be used to find out which emails exist
+		user, err := h.repo.Get(req.Context(), body.Email)
+		if err == nil && !user.IsServiceAccount() {
+			err = h.mailer.SendPasswordReset(req.Context(), user)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			util.RequestLogger(h.logger, req).Error("error sending password reset mail", "error", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	case "/password-reset/confirm":
+		var body resetPasswordBody
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Token == "" || body.Password == "" {
+			util.JsonError("Both 'token' and 'password' are required", http.StatusBadRequest, w)
+			return
+		}
+		if err := h.passwords.Check(body.Password); err != nil {
+			util.JsonError(err.Error(), http.StatusBadRequest, w)
+			return
+		}
+
+		user, err := useToken(req.Context(), h.tokens, h.repo, PURPOSE_RESET_PASSWORD, body.Token)
+		if errors.Is(err, sql.ErrNoRows) {
+			util.JsonError("Invalid or expired token", http.StatusBadRequest, w)
+			return
+		}
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+
+		hash, err := h.passwords.Hash(body.Password)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		err = h.repo.UpdatePassword(req.Context(), user.Id, hash)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		// the token was mailed, so the user also proved they own the email
+		err = h.repo.MarkVerified(req.Context(), user.Id)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		// whoever knew the old password shouldn't stay logged in
+		err = h.revocations.RevokeUser(req.Context(), user.Id)
+		if err != nil {
+			util.ErrorResponse(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
+)
+
+// fakeTokenRepo keeps the user and email of every unused token by purpose and
+// hash.
+type fakeTokenRepo map[string]User
+
+func (r fakeTokenRepo) Create(ctx context.Context, userId int64, email string, purpose string, tokenHash string) error {
+	r[purpose+tokenHash] = User{Id: userId, Email: email}
+	return nil
+}
+
+func (r fakeTokenRepo) Use(ctx context.Context, purpose string, tokenHash string) (int64, string, error) {
+	user, ok := r[purpose+tokenHash]
+	if !ok {
+		return 0, "", sql.ErrNoRows
+	}
+	delete(r, purpose+tokenHash)
+	return user.Id, user.Email, nil
+}
+
+func mailedToken(t *testing.T, sent []mail.Message) string {
+	if len(sent) != 1 {
+		t.Fatalf("1 mail should be sent but were %d", len(sent))
+	}
+	lines := strings.Split(sent[0].Body, "\n")
+	return lines[2]
+}
+
+func post(handler http.Handler, path string, body string) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return recorder.Result().StatusCode
+}
+
+func TestSignUpEmailVerification(t *testing.T) {
+	var sent []mail.Message
+	users := fakeUsers{}
+	tokens := fakeTokenRepo{}
+	mailer := NewAccountMailer(tokens, fakeMailer{&sent}, "http://test")
+	signUp := NewSignUpHandler(context.Background(), logging.Default(), users, testPasswords, mailer)
+	verify := NewVerifyEmailHandler(context.Background(), logging.Default(), users, tokens, mailer)
+
+	if statusCode := post(signUp, "/signup", `{"email": "new@test.com", "password": "pass1234"}`); statusCode != 201 {
+		t.Fatalf("Status code should be 201 but is %d", statusCode)
+	}
+	token := mailedToken(t, sent)
+
+	if statusCode := post(verify, "/verify-email", `{"token": "`+token+`"}`); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	if !users["new@test.com"].EmailVerified {
+		t.Fatal("email should be verified")
+	}
+	if statusCode := post(verify, "/verify-email", `{"token": "`+token+`"}`); statusCode != 400 {
+		t.Fatalf("tokens should be single use, got %d", statusCode)
+	}
+}
+
+func TestAuthRequiresVerifiedEmail(t *testing.T) {
+	passwordHash, _ := testPasswords.Hash("pass1234")
+	repo := fakeRepo{User{Id: 10, Email: "test@test.com", PasswordHash: passwordHash}}
+	handler := NewAuthUpHandler(context.Background(), logging.Default(), repo, testPasswords, newFakeTwoFactorRepo(), newTestThrottle(), newTestSessions(t))
+
+	if statusCode := post(handler, "/auth", `{"email": "test@test.com", "password": "pass1234"}`); statusCode != 403 {
+		t.Fatalf("Status code should be 403 but is %d", statusCode)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	var sent []mail.Message
+	users := fakeUsers{"old@test.com": User{Id: 10, Email: "old@test.com"}}
+	tokens := fakeTokenRepo{}
+	mailer := NewAccountMailer(tokens, fakeMailer{&sent}, "http://test")
+	revocations := newTestRevocationList(t)
+	handler := NewPasswordResetHandler(context.Background(), logging.Default(), users, testPasswords, tokens, mailer, revocations)
+
+	if statusCode := post(handler, "/password-reset", `{"email": "unknown@test.com"}`); statusCode != 200 {
+		t.Fatalf("unknown emails should get the same answer, got %d", statusCode)
+	}
+	if len(sent) != 0 {
+		t.Fatal("no mail should be sent to unknown emails")
+	}
+
+	post(handler, "/password-reset", `{"email": "old@test.com"}`)
+	token := mailedToken(t, sent)
+
+	body := `{"token": "` + token + `", "password": "new password"}`
+	if statusCode := post(handler, "/password-reset/confirm", body); statusCode != 200 {
+		t.Fatalf("Status code should be 200 but is %d", statusCode)
+	}
+	if !validatePass("new password", users["old@test.com"].PasswordHash) {
+		t.Fatal("password should be updated")
+	}
+	if !revocations.IsRevoked(jwtPayload{UserId: 10}) {
+		t.Fatal("existing sessions should be revoked")
+	}
+	if statusCode := post(handler, "/password-reset/confirm", body); statusCode != 400 {
+		t.Fatalf("tokens should be single use, got %d", statusCode)
+	}
+}
+
+func TestVerificationOfPreviousEmail(t *testing.T) {
+	var sent []mail.Message
+	users := fakeUsers{"old@test.com": User{Id: 10, Email: "old@test.com"}}
+	tokens := fakeTokenRepo{}
+	mailer := NewAccountMailer(tokens, fakeMailer{&sent}, "http://test")
+	verify := NewVerifyEmailHandler(context.Background(), logging.Default(), users, tokens, mailer)
+
+	post(verify, "/verify-email/resend", `{"email": "old@test.com"}`)
+	token := mailedToken(t, sent)
+	users.SetPendingEmail(context.Background(), 10, "new@test.com")
+	users.ConfirmEmail(context.Background(), 10, "new@test.com")
+
+	if statusCode := post(verify, "/verify-email", `{"token": "`+token+`"}`); statusCode != 400 {
+		t.Fatalf("tokens of the previous email shouldn't verify the new one, got %d", statusCode)
+	}
+}
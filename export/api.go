@@ -0,0 +1,217 @@
+package export
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/auth"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/toggles"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+// Export holds everything stored about a user, secrets like the password
+// hash, key and token hashes, recovery codes or the TOTP secret are left out.
+type Export struct {
+	ExportedAt       time.Time                `json:"exported_at"`
+	Profile          auth.ProfileResponse     `json:"profile"`
+	TwoFactorEnabled bool                     `json:"two_factor_enabled"`
+	Sessions         []Session                `json:"sessions"`
+	Identities       []auth.Identity          `json:"oidc_identities"`
+	Organizations    []Membership             `json:"organizations"`
+	Invitations      []Invitation             `json:"invitations"`
+	APIKeys          []APIKey                 `json:"api_keys"`
+	Toggles          []toggles.AuthoredToggle `json:"toggles"`
+	AuditEvents      []audit.Event            `json:"audit_events"`
+}
+
+type Session struct {
+	auth.Session
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked"`
+}
+
+type Membership struct {
+	auth.Organization
+	Role string `json:"role"`
+}
+
+type APIKey struct {
+	auth.APIKey
+	OrgId int64 `json:"org_id"`
+}
+
+type Invitation struct {
+	auth.Invitation
+	OrgId int64 `json:"org_id"`
+}
+
+type handler struct {
+	ctx         context.Context
+	users       auth.UserRepository
+	twoFactor   auth.TwoFactorRepository
+	sessions    *auth.Sessions
+	identities  auth.IdentityRepository
+	orgs        auth.OrgRepository
+	invitations auth.InvitationRepository
+	keys        auth.APIKeyRepository
+	toggles     toggles.ToggleRepo
+	audit       audit.Repository
+	logger      *logging.Logger
+}
+
+func NewHandler(
+	ctx context.Context,
+	logger *logging.Logger,
+	users auth.UserRepository,
+	twoFactor auth.TwoFactorRepository,
+	sessions *auth.Sessions,
+	identities auth.IdentityRepository,
+	orgs auth.OrgRepository,
+	invitations auth.InvitationRepository,
+	keys auth.APIKeyRepository,
+	toggleRepo toggles.ToggleRepo,
+	auditRepo audit.Repository,
+) http.Handler {
+	return handler{ctx, users, twoFactor, sessions, identities, orgs, invitations, keys, toggleRepo, auditRepo, logger}
+}
+
+// handler serves GET /me/export for the caller and GET /admin/users/<id>/export
+// for admins answering data subject requests, the admin scope is checked
+// when the route is registered.
+func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := auth.GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	userId := principal.UserId
+	if req.URL.Path == "/me/export" {
+		if principal.IsAPIKey() {
+			util.JsonError("API keys can't export the account", http.StatusForbidden, w)
+			return
+		}
+	} else {
+		id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/admin/users/"), "/export")
+		userId, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			util.JsonError("A valid id is required: /admin/users/<id>/export", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	export, err := h.export(req.Context(), userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	util.RequestLogger(h.logger, req).Info("personal data exported", "user_id", userId, "exported_by", principal.UserId)
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d-export.json\"", userId))
+	util.JsonResponse(export, http.StatusOK, w)
+}
+
+func (h handler) export(ctx context.Context, userId int64) (Export, error) {
+	export := Export{ExportedAt: time.Now().UTC()}
+
+	user, err := h.users.GetById(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+	export.Profile = auth.ProfileResponse{
+		Id:            user.Id,
+		Email:         user.Email,
+		DisplayName:   user.DisplayName,
+		EmailVerified: user.EmailVerified,
+		PendingEmail:  user.PendingEmail,
+	}
+
+	twoFactor, err := h.twoFactor.Get(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+	export.TwoFactorEnabled = twoFactor.Enabled
+
+	sessions, err := h.sessions.All(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+	export.Sessions = []Session{}
+	for _, session := range sessions {
+		expiresAt := time.Unix(session.IssuedAt+auth.EXPIRATION_TIME_SECONDS, 0).UTC()
+		export.Sessions = append(export.Sessions, Session{session, expiresAt, session.Revoked})
+	}
+
+	export.Identities, err = h.identities.ByUser(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+
+	orgs, err := h.orgs.GetAll(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+	export.Organizations = []Membership{}
+	for _, org := range orgs {
+		role, err := h.orgs.Role(ctx, org.Id, userId)
+		if err != nil {
+			return export, err
+		}
+		export.Organizations = append(export.Organizations, Membership{org, role})
+	}
+
+	invitations, err := h.invitations.ByUser(ctx, userId, user.Email)
+	if err != nil {
+		return export, err
+	}
+	export.Invitations = []Invitation{}
+	for _, invitation := range invitations {
+		export.Invitations = append(export.Invitations, Invitation{invitation, invitation.OrgId})
+	}
+
+	keys, err := h.keys.ByUser(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+	export.APIKeys = []APIKey{}
+	for _, key := range keys {
+		export.APIKeys = append(export.APIKeys, APIKey{key, key.OrgId})
+	}
+
+	export.Toggles, err = h.toggles.ByAuthor(ctx, userId)
+	if err != nil {
+		return export, err
+	}
+
+	// what the user did and what was done to the account, like lockouts
+	export.AuditEvents, err = h.audit.ByActor(ctx, audit.ACTOR_USER, userId)
+	if err != nil {
+		return export, err
+	}
+	if user.Email != "" {
+		events, err := h.audit.ByTarget(ctx, auth.AccountTarget(user.Email))
+		if err != nil {
+			return export, err
+		}
+		export.AuditEvents = append(export.AuditEvents, events...)
+	}
+
+	return export, nil
+}
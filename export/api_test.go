@@ -0,0 +1,189 @@
+package export
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/auth"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/toggles"
+)
+
+// the fakes only implement what the export reads
+
+type fakeUsers struct {
+	auth.UserRepository
+}
+
+func (fakeUsers) GetById(ctx context.Context, id int64) (auth.User, error) {
+	if id != 10 {
+		return auth.User{}, sql.ErrNoRows
+	}
+	return auth.User{Id: 10, Email: "me@test.com", PasswordHash: "secret-hash", DisplayName: "Me"}, nil
+}
+
+type fakeSessions struct{}
+
+func (fakeSessions) Create(ctx context.Context, session auth.Session) error {
+	return nil
+}
+
+func (fakeSessions) Active(ctx context.Context, userId int64, issuedAfter int64) ([]auth.Session, error) {
+	return []auth.Session{{Id: "jti", UserId: userId, UserAgent: "curl"}}, nil
+}
+
+func (fakeSessions) ByUser(ctx context.Context, userId int64) ([]auth.Session, error) {
+	return []auth.Session{{Id: "jti", UserId: userId, UserAgent: "curl"}, {Id: "old", UserId: userId, Revoked: true}}, nil
+}
+
+func (fakeSessions) Touch(ctx context.Context, id string, ip string) error {
+	return nil
+}
+
+type fakeTwoFactor struct {
+	auth.TwoFactorRepository
+}
+
+func (fakeTwoFactor) Get(ctx context.Context, userId int64) (auth.TwoFactor, error) {
+	return auth.TwoFactor{Email: "me@test.com", Secret: "totp-secret", Enabled: true}, nil
+}
+
+type fakeIdentities struct {
+	auth.IdentityRepository
+}
+
+func (fakeIdentities) ByUser(ctx context.Context, userId int64) ([]auth.Identity, error) {
+	return []auth.Identity{{Issuer: "https://idp.test", Subject: "subject-1"}}, nil
+}
+
+type fakeInvitations struct {
+	auth.InvitationRepository
+}
+
+func (fakeInvitations) ByUser(ctx context.Context, userId int64, email string) ([]auth.Invitation, error) {
+	return []auth.Invitation{{Id: 7, OrgId: 2, Email: email, Role: auth.ROLE_EDITOR, InvitedBy: 1}}, nil
+}
+
+type fakeOrgs struct {
+	auth.OrgRepository
+}
+
+func (fakeOrgs) GetAll(ctx context.Context, userId int64) ([]auth.Organization, error) {
+	return []auth.Organization{{Id: 1, Name: "me@test.com"}}, nil
+}
+
+func (fakeOrgs) Role(ctx context.Context, orgId int64, userId int64) (string, error) {
+	return auth.ROLE_OWNER, nil
+}
+
+type fakeKeys struct {
+	auth.APIKeyRepository
+}
+
+func (fakeKeys) ByUser(ctx context.Context, userId int64) ([]auth.APIKey, error) {
+	return []auth.APIKey{{Id: 3, UserId: userId, OrgId: 1, Name: "backend", Type: auth.SERVER_KEY}}, nil
+}
+
+type fakeToggles struct {
+	toggles.ToggleRepo
+}
+
+func (fakeToggles) ByAuthor(ctx context.Context, userId int64) ([]toggles.AuthoredToggle, error) {
+	return []toggles.AuthoredToggle{{Id: "dark-mode", Value: "on", OrgId: 1}}, nil
+}
+
+type fakeAudit struct {
+	audit.Repository
+}
+
+func (fakeAudit) ByActor(ctx context.Context, actorType string, actorId int64) ([]audit.Event, error) {
+	return []audit.Event{{Id: 5, ActorType: actorType, ActorId: actorId, Action: "toggle.create"}}, nil
+}
+
+func (fakeAudit) ByTarget(ctx context.Context, target string) ([]audit.Event, error) {
+	return []audit.Event{{Id: 4, ActorType: audit.ACTOR_ANONYMOUS, Action: "auth.lockout", Target: target}}, nil
+}
+
+func serveExport(path string, principal auth.Principal) *httptest.ResponseRecorder {
+	handler := NewHandler(
+		context.Background(),
+		logging.Default(),
+		fakeUsers{},
+		fakeTwoFactor{},
+		auth.NewSessions(fakeSessions{}, nil),
+		fakeIdentities{},
+		fakeOrgs{},
+		fakeInvitations{},
+		fakeKeys{},
+		fakeToggles{},
+		fakeAudit{},
+	)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", path, nil)
+	handler.ServeHTTP(recorder, request.WithContext(auth.WithPrincipal(request.Context(), principal)))
+
+	return recorder
+}
+
+func TestExport(t *testing.T) {
+	recorder := serveExport("/me/export", auth.Principal{UserId: 10, OrgId: 1, Role: auth.ROLE_OWNER})
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status code should be 200 but is %d", recorder.Code)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatal("export should be downloaded as a file")
+	}
+	if strings.Contains(recorder.Body.String(), "secret-hash") || strings.Contains(recorder.Body.String(), "totp-secret") {
+		t.Fatal("export shouldn't contain the password hash nor the TOTP secret")
+	}
+
+	var export Export
+	json.NewDecoder(recorder.Body).Decode(&export)
+	if export.Profile.Email != "me@test.com" || export.Profile.DisplayName != "Me" {
+		t.Fatalf("unexpected profile %+v", export.Profile)
+	}
+	if len(export.Organizations) != 1 || export.Organizations[0].Role != auth.ROLE_OWNER {
+		t.Fatalf("unexpected organizations %+v", export.Organizations)
+	}
+	if len(export.APIKeys) != 1 || export.APIKeys[0].OrgId != 1 {
+		t.Fatalf("unexpected api keys %+v", export.APIKeys)
+	}
+	if len(export.Sessions) != 2 || !export.Sessions[1].Revoked {
+		t.Fatalf("every session should be exported, revoked ones included, got %+v", export.Sessions)
+	}
+	if len(export.Identities) != 1 || len(export.Invitations) != 1 || export.Invitations[0].OrgId != 2 || !export.TwoFactorEnabled {
+		t.Fatalf("unexpected identities %+v, invitations %+v or two-factor", export.Identities, export.Invitations)
+	}
+	if len(export.Toggles) != 1 {
+		t.Fatal("toggles should be exported")
+	}
+	if len(export.AuditEvents) != 2 || export.AuditEvents[1].Target != auth.AccountTarget("me@test.com") {
+		t.Fatalf("events of the user and about the account should be exported, got %+v", export.AuditEvents)
+	}
+}
+
+func TestExportWithAPIKey(t *testing.T) {
+	recorder := serveExport("/me/export", auth.Principal{UserId: 10, OrgId: 1, KeyId: 3, KeyType: auth.SERVER_KEY})
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("Status code should be 403 but is %d", recorder.Code)
+	}
+}
+
+func TestAdminExport(t *testing.T) {
+	admin := auth.Principal{UserId: 1, OrgId: 1, Role: auth.ROLE_OWNER}
+
+	if recorder := serveExport("/admin/users/10/export", admin); recorder.Code != http.StatusOK {
+		t.Fatalf("Status code should be 200 but is %d", recorder.Code)
+	}
+	if recorder := serveExport("/admin/users/99/export", admin); recorder.Code != http.StatusNotFound {
+		t.Fatalf("Status code should be 404 but is %d", recorder.Code)
+	}
+}
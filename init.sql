@@ -10,3 +10,159 @@ CREATE TABLE IF NOT EXISTS toggles (
     user_id INT NOT NULL,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_generation INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR (50) PRIMARY KEY,
+    expires_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR (50) NOT NULL,
+    key_type VARCHAR (10) NOT NULL,
+    prefix VARCHAR (10) NOT NULL,
+    key_hash VARCHAR (64) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS scopes VARCHAR (250) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS organizations (
+    id serial PRIMARY KEY,
+    name VARCHAR (50) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS memberships (
+    org_id INT NOT NULL,
+    user_id INT NOT NULL,
+    PRIMARY KEY (org_id, user_id),
+    FOREIGN KEY (org_id) REFERENCES organizations(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE toggles ADD COLUMN IF NOT EXISTS org_id INT REFERENCES organizations(id);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS org_id INT REFERENCES organizations(id);
+
+-- move users created before organizations existed into a personal one
+DO $$
+DECLARE
+    u RECORD;
+    new_org_id INT;
+BEGIN
+    FOR u IN SELECT id, email FROM users WHERE id NOT IN (SELECT user_id FROM memberships) LOOP
+        INSERT INTO organizations (name) VALUES (u.email) RETURNING id INTO new_org_id;
+        INSERT INTO memberships (org_id, user_id) VALUES (new_org_id, u.id);
+        UPDATE toggles SET org_id = new_org_id WHERE user_id = u.id AND org_id IS NULL;
+        UPDATE api_keys SET org_id = new_org_id WHERE user_id = u.id AND org_id IS NULL;
+    END LOOP;
+END $$;
+
+ALTER TABLE memberships ADD COLUMN IF NOT EXISTS role VARCHAR (10) NOT NULL DEFAULT 'owner';
+
+CREATE TABLE IF NOT EXISTS invitations (
+    id serial PRIMARY KEY,
+    org_id INT NOT NULL,
+    email VARCHAR (50) NOT NULL,
+    role VARCHAR (10) NOT NULL,
+    invited_by INT NOT NULL,
+    token_hash VARCHAR (64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP,
+    FOREIGN KEY (org_id) REFERENCES organizations(id),
+    FOREIGN KEY (invited_by) REFERENCES users(id)
+);
+
+-- users created before verification existed are considered verified
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+    token_hash VARCHAR (64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    purpose VARCHAR (20) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR (64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id INT NOT NULL,
+    code_hash VARCHAR (64) NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id serial PRIMARY KEY,
+    org_id INT,
+    actor_type VARCHAR (20) NOT NULL,
+    actor_id INT,
+    action VARCHAR (50) NOT NULL,
+    target VARCHAR (250) NOT NULL,
+    ip VARCHAR (50) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS oidc_identities (
+    issuer VARCHAR (250) NOT NULL,
+    subject VARCHAR (250) NOT NULL,
+    user_id INT NOT NULL,
+    PRIMARY KEY (issuer, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR (50) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR (50) PRIMARY KEY,
+    user_id INT NOT NULL,
+    generation INT NOT NULL,
+    issued_at BIGINT NOT NULL,
+    user_agent VARCHAR (250) NOT NULL DEFAULT '',
+    ip VARCHAR (50) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP NOT NULL DEFAULT now(),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- service accounts are users owned by an organization, without email
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS service_org_id INT REFERENCES organizations(id);
+
+-- toggles are set per environment, '' being the one toggles had before
+ALTER TABLE toggles ADD COLUMN IF NOT EXISTS environment VARCHAR (20) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS environment_restrictions (
+    org_id INT NOT NULL,
+    environment VARCHAR (20) NOT NULL,
+    role VARCHAR (10) NOT NULL,
+    PRIMARY KEY (org_id, environment),
+    FOREIGN KEY (org_id) REFERENCES organizations(id)
+);
+
+-- tokens are only valid for the email they were mailed to, the ones mailed
+-- before don't have it and can be requested again
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS email VARCHAR (50);
+
+-- keys can be restricted to the toggles of one environment, '' is any
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS environment VARCHAR (20) NOT NULL DEFAULT '';
+
+-- requests without an organization header act on the user's personal
+-- organization, not on whichever organization they joined first
+ALTER TABLE users ADD COLUMN IF NOT EXISTS default_org_id INT REFERENCES organizations(id);
+UPDATE users u SET default_org_id = (
+    SELECT min(m.org_id) FROM memberships m WHERE m.user_id = u.id AND m.role = 'owner'
+) WHERE default_org_id IS NULL AND service_org_id IS NULL;
+
+-- a new email only replaces the current one once verified
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email VARCHAR (50);
@@ -0,0 +1,173 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = map[Level]string{DEBUG: "debug", INFO: "info", WARN: "warn", ERROR: "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel reads levels as written in LOG_LEVEL, an empty one is INFO.
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return INFO, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level: %s", name)
+}
+
+// Logger writes one JSON object per line with the time, level, message and
+// the fields given as key value pairs, e.g.
+//
+//	logger.Info("account deleted", "user_id", user.Id)
+//
+// Fields whose key looks like a secret are redacted, see redact.
+type Logger struct {
+	out    *output
+	level  Level
+	fields []any
+}
+
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{&output{w: w}, level, nil}
+}
+
+var defaultLogger = New(os.Stderr, INFO)
+
+// Default is the logger used where none is passed, like util.ErrorResponse.
+func Default() *Logger {
+	return defaultLogger
+}
+
+func SetDefault(logger *Logger) {
+	defaultLogger = logger
+}
+
+// With returns a logger adding the fields to every line.
+func (l *Logger) With(keyvals ...any) *Logger {
+	fields := make([]any, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &Logger{l.out, l.level, append(fields, keyvals...)}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...any) {
+	l.log(DEBUG, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...any) {
+	l.log(INFO, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...any) {
+	l.log(WARN, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...any) {
+	l.log(ERROR, msg, keyvals)
+}
+
+// Fatal logs at ERROR level and exits, for errors while starting up.
+func (l *Logger) Fatal(msg string, keyvals ...any) {
+	l.log(ERROR, msg, keyvals)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []any) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeValue(&b, msg)
+	writeFields(&b, l.fields)
+	writeFields(&b, keyvals)
+	b.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+func writeFields(b *bytes.Buffer, keyvals []any) {
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value any = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+
+		b.WriteByte(',')
+		writeValue(b, key)
+		b.WriteByte(':')
+		writeValue(b, redact(key, value))
+	}
+}
+
+func writeValue(b *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(encoded)
+}
+
+// secretKeys are the parts of field names whose values are never written.
+var secretKeys = []string{"password", "pass", "hash", "secret", "token", "authorization", "cookie"}
+
+const REDACTED = "[REDACTED]"
+
+func redact(key string, value any) any {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return REDACTED
+		}
+	}
+	return value
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, INFO).With("request_id", "abc")
+
+	logger.Debug("hidden")
+	logger.Info("user logged in", "user_id", 10, "password_hash", "$2a$10$...", "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("only lines at or above the level should be written, got %d", len(lines))
+	}
+	var line map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal("lines should be JSON", err)
+	}
+	expected := map[string]any{
+		"level":         "info",
+		"msg":           "user logged in",
+		"request_id":    "abc",
+		"user_id":       float64(10),
+		"password_hash": REDACTED,
+		"error":         "boom",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Fatalf("%s should be %v but is %v", key, value, line[key])
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != WARN {
+		t.Fatalf("level should be warn, got %v %v", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("unknown levels should be rejected")
+	}
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"context"
+	"sync"
+)
+
+type requestFieldsKey struct{}
+
+type requestFields struct {
+	mu      sync.Mutex
+	keyvals []any
+}
+
+// WithRequestFields returns a context collecting the fields added with
+// AddRequestFields while the request is served, for the access log to
+// include things only known deeper in the handlers, like the user id.
+func WithRequestFields(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestFieldsKey{}, &requestFields{})
+}
+
+func AddRequestFields(ctx context.Context, keyvals ...any) {
+	fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	fields.keyvals = append(fields.keyvals, keyvals...)
+}
+
+func RequestFields(ctx context.Context) []any {
+	fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields)
+	if !ok {
+		return nil
+	}
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	return append([]any{}, fields.keyvals...)
+}
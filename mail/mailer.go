@@ -0,0 +1,154 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SEND_TIMEOUT bounds sending a mail when the context has no deadline.
+const SEND_TIMEOUT = 30 * time.Second
+
+type smtpMailer struct {
+	host string
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer sends mails through the server at host:port, using plain auth
+// when a user is given.
+func NewSMTPMailer(host string, port string, user string, password string, from string) Mailer {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return smtpMailer{host, host + ":" + port, auth, from}
+}
+
+// Send does what smtp.SendMail does, on a connection that gives up when ctx
+// is done or after SEND_TIMEOUT.
+func (m smtpMailer) Send(ctx context.Context, msg Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, SEND_TIMEOUT)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// the deadline doesn't cover cancellation, closing the connection does
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = m.send(conn, msg)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (m smtpMailer) send(conn net.Conn, msg Message) error {
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(format(m.from, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+type logMailer struct {
+	logger     *logging.Logger
+	showBodies bool
+}
+
+// NewLogMailer logs mails instead of sending them, meant for local
+// development and tests. Bodies carry tokens, they are redacted unless
+// showBodies is set.
+func NewLogMailer(logger *logging.Logger, showBodies bool) Mailer {
+	return logMailer{logger, showBodies}
+}
+
+func (m logMailer) Send(ctx context.Context, msg Message) error {
+	body := logging.REDACTED
+	if m.showBodies {
+		body = msg.Body
+	}
+	m.logger.Info("mail not sent, logged instead", "to", msg.To, "subject", msg.Subject, "body", body)
+	return nil
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
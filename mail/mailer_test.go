@@ -0,0 +1,72 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+func TestLogMailer(t *testing.T) {
+	var output bytes.Buffer
+	mailer := NewLogMailer(logging.New(&output, logging.INFO), true)
+
+	err := mailer.Send(context.Background(), Message{"ibado@test.com", "Hi", "some body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"ibado@test.com", "Hi", "some body"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("mail should contain '%s' but is '%s'", expected, output.String())
+		}
+	}
+}
+
+func TestLogMailerRedactsBodies(t *testing.T) {
+	var output bytes.Buffer
+	mailer := NewLogMailer(logging.New(&output, logging.INFO), false)
+
+	mailer.Send(context.Background(), Message{"ibado@test.com", "Hi", "secret token"})
+
+	if strings.Contains(output.String(), "secret token") || !strings.Contains(output.String(), logging.REDACTED) {
+		t.Errorf("the body should be redacted but is '%s'", output.String())
+	}
+}
+
+func TestSMTPMailerGivesUpWithContext(t *testing.T) {
+	// a server that accepts connections but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	mailer := NewSMTPMailer(host, port, "", "", "no-reply@test.com")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = mailer.Send(ctx, Message{"ibado@test.com", "Hi", "some body"})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error should be the context deadline but is %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("sending should stop at the context deadline but took %s", time.Since(start))
+	}
+}
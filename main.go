@@ -2,23 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"myfeaturetoggles.com/toggles/audit"
 	"myfeaturetoggles.com/toggles/auth"
+	"myfeaturetoggles.com/toggles/export"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/mail"
+	"myfeaturetoggles.com/toggles/metrics"
 	"myfeaturetoggles.com/toggles/router"
 	"myfeaturetoggles.com/toggles/toggles"
+	"myfeaturetoggles.com/toggles/tracing"
 	"myfeaturetoggles.com/toggles/util"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var ctx = context.Background()
 var dbConnection *sql.DB = nil
-var logger = log.Default()
+var logger = logging.Default()
+var metricsRegistry = metrics.NewRegistry()
 
 func health(w http.ResponseWriter, req *http.Request) {
 	util.JsonResponse(map[string]string{"status": "healthy"}, http.StatusOK, w)
@@ -26,32 +38,164 @@ func health(w http.ResponseWriter, req *http.Request) {
 
 func createDBConnection() *sql.DB {
 	url := os.Getenv("CCDB_URL")
-	db, err := sql.Open("postgres", url)
+	connector, err := pq.NewConnector(url)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("error opening database", "error", err)
 		return nil
 	}
+	db := sql.OpenDB(metrics.InstrumentConnector(connector, metricsRegistry))
 
 	sql, err := ioutil.ReadFile("init.sql")
 	if err != nil {
-		logger.Fatalln("error reading sql init file", err)
+		logger.Fatal("error reading sql init file", "error", err)
 	}
 	_, err = db.Exec(string(sql))
 	if err != nil {
-		logger.Fatalln("error running init.sql", err)
+		logger.Fatal("error running init.sql", "error", err)
 	}
 	return db
 }
 
-var loggingMiddleware = func(next http.Handler) http.Handler {
+// createMailer sends mails through SMTP when SMTP_HOST is set. Without it the
+// server refuses to start unless MAIL_LOG=true, then mails are only logged,
+// with their bodies when MAIL_LOG_BODIES=true.
+func createMailer() mail.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		// without mails nobody can verify their email or reset their password,
+		// logging them instead has to be asked for
+		if os.Getenv("MAIL_LOG") != "true" {
+			logger.Fatal("SMTP_HOST is required, set MAIL_LOG=true to log mails instead in development")
+		}
+		logger.Warn("mails are logged, not sent")
+		return mail.NewLogMailer(logger, os.Getenv("MAIL_LOG_BODIES") == "true")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return mail.NewSMTPMailer(
+		host,
+		port,
+		os.Getenv("SMTP_USER"),
+		os.Getenv("SMTP_PASSWORD"),
+		os.Getenv("MAIL_FROM"),
+	)
+}
+
+// createPasswords reads the password policy from PASSWORD_MIN_LENGTH,
+// BREACHED_PASSWORDS_FILE and BCRYPT_COST.
+func createPasswords() *auth.Passwords {
+	policy := auth.PasswordPolicy{MinLength: envInt("PASSWORD_MIN_LENGTH", 8)}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breached, err := auth.LoadBreachedPasswords(path)
+		if err != nil {
+			logger.Fatal("error reading breached passwords", "error", err)
+		}
+		policy.Breached = breached
+	}
+
+	passwords, err := auth.NewPasswords(policy, envInt("BCRYPT_COST", bcrypt.DefaultCost))
+	if err != nil {
+		logger.Fatal("invalid password policy", "error", err)
+	}
+	return passwords
+}
+
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Fatal("setting should be a number", "name", name, "value", value)
+	}
+	return i
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Fatal("setting should be a duration like 30s", "name", name, "value", value)
+	}
+	return d
+}
+
+// requireMetricsToken restricts /metrics to scrapers sending
+// "Authorization: Bearer <METRICS_TOKEN>" when the variable is set.
+func requireMetricsToken(next http.Handler) http.Handler {
+	token := os.Getenv("METRICS_TOKEN")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqLog := r.Method + " " + r.URL.Path
-		logger.Println(reqLog)
+		given := []byte(r.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// createTracer exports traces as set by TRACES_EXPORTER: "otlp" to the
+// collector at OTEL_EXPORTER_OTLP_ENDPOINT, "file" to TRACES_FILE, or
+// nowhere when empty.
+func createTracer() *tracing.Tracer {
+	switch exporter := os.Getenv("TRACES_EXPORTER"); exporter {
+	case "":
+		return tracing.NewTracer(nil)
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		onError := func(err error) { logger.Warn("error exporting traces", "error", err) }
+		client := &http.Client{Timeout: 10 * time.Second}
+		return tracing.NewTracer(tracing.NewOTLPExporter(endpoint, "toggles", client, onError))
+	case "file":
+		path := os.Getenv("TRACES_FILE")
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Fatal("error opening traces file", "error", err)
+		}
+		return tracing.NewTracer(tracing.NewFileExporter(file))
+	default:
+		logger.Fatal("invalid TRACES_EXPORTER", "exporter", exporter)
+		return nil
+	}
+}
+
+// createAccessLog logs requests as JSON through the logger, unless
+// ACCESS_LOG_FORMAT asks for the Common or Combined Log Format on stdout.
+func createAccessLog() router.Middleware {
+	format := os.Getenv("ACCESS_LOG_FORMAT")
+	if format == "" || format == router.ACCESS_LOG_JSON {
+		return router.AccessLog(logger)
+	}
+	accessLog, err := router.FormattedAccessLog(os.Stdout, format)
+	if err != nil {
+		logger.Fatal("invalid ACCESS_LOG_FORMAT", "error", err)
+	}
+	return accessLog
+}
+
 func main() {
+	level, err := logging.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		logger.Fatal("invalid LOG_LEVEL", "error", err)
+	}
+	logger = logging.New(os.Stderr, level)
+	logging.SetDefault(logger)
+
+	tracer := createTracer()
+	tracing.SetDefault(tracer)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
@@ -64,26 +208,175 @@ func main() {
 
 	repo := toggles.NewRepo(dbConnection)
 	userRepo := auth.NewUserRepo(dbConnection)
-	handleToggles := toggles.NewHandler(ctx, repo, logger)
-	handleSignUp := auth.NewSignUpHandler(ctx, logger, userRepo)
-	handleAuth := auth.NewAuthUpHandler(ctx, logger, userRepo)
+	apiKeyRepo := auth.NewAPIKeyRepo(dbConnection)
+	orgRepo := auth.NewOrgRepo(dbConnection)
+	invitationRepo := auth.NewInvitationRepo(dbConnection)
+	mailer := createMailer()
+	tokenRepo := auth.NewTokenRepo(dbConnection)
+	twoFactorRepo := auth.NewTwoFactorRepo(dbConnection)
+	identityRepo := auth.NewIdentityRepo(dbConnection)
+	auditRepo := audit.NewRepo(dbConnection)
+	loginThrottle := auth.NewLoginThrottle(auditRepo)
+	passwords := createPasswords()
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + port
+	}
+	accountMailer := auth.NewAccountMailer(tokenRepo, mailer, baseURL)
+	revocations, err := auth.NewRevocationList(ctx, auth.NewRevocationRepo(dbConnection))
+	if err != nil {
+		logger.Fatal("error loading revoked tokens", "error", err)
+	}
+	sessions := auth.NewSessions(auth.NewSessionRepo(dbConnection), revocations)
+	environmentRepo := auth.NewEnvironmentRepo(dbConnection)
+	handleToggles := toggles.NewHandler(ctx, repo, environmentRepo, logger, auditRepo, metricsRegistry)
+	handleSignUp := auth.NewSignUpHandler(ctx, logger, userRepo, passwords, accountMailer)
+	handleAuth := auth.NewAuthUpHandler(ctx, logger, userRepo, passwords, twoFactorRepo, loginThrottle, sessions)
+	handleTwoFactor := auth.NewTwoFactorHandler(ctx, logger, twoFactorRepo)
+	handleProfile := auth.NewProfileHandler(ctx, logger, userRepo, passwords, accountMailer, revocations, sessions, loginThrottle)
+	handleSessions := auth.NewSessionHandler(ctx, logger, sessions)
+	handleExport := export.NewHandler(
+		ctx,
+		logger,
+		userRepo,
+		twoFactorRepo,
+		sessions,
+		identityRepo,
+		orgRepo,
+		invitationRepo,
+		apiKeyRepo,
+		repo,
+		auditRepo,
+	)
+	handleVerifyEmail := auth.NewVerifyEmailHandler(ctx, logger, userRepo, tokenRepo, accountMailer)
+	handlePasswordReset := auth.NewPasswordResetHandler(ctx, logger, userRepo, passwords, tokenRepo, accountMailer, revocations)
+	handleLogout := auth.NewLogoutHandler(ctx, logger, revocations)
+	handleRevokeSessions := auth.NewRevokeSessionsHandler(ctx, logger, revocations)
+	handleAPIKeys := auth.NewAPIKeyHandler(ctx, logger, apiKeyRepo)
+	handleOrgs := auth.NewOrgHandler(ctx, logger, orgRepo)
+	handleMembers := auth.NewMembersHandler(ctx, logger, orgRepo)
+	handleServiceAccounts := auth.NewServiceAccountHandler(
+		ctx,
+		logger,
+		auth.NewServiceAccountRepo(dbConnection),
+		orgRepo,
+		userRepo,
+		apiKeyRepo,
+		auditRepo,
+	)
+	handleAudit := auth.NewAuditHandler(ctx, logger, auditRepo)
+	handleEnvironments := auth.NewEnvironmentHandler(ctx, logger, environmentRepo, auditRepo)
+	handleInvitations := auth.NewInvitationHandler(ctx, logger, invitationRepo, mailer, baseURL)
+	handleAcceptInvitation := auth.NewAcceptInvitationHandler(ctx, logger, invitationRepo, userRepo, passwords, twoFactorRepo, loginThrottle, sessions)
 
 	mux := router.NewRouter()
-	mux.Use(loggingMiddleware)
+	mux.Use(router.RequestID)
+	mux.Use(createAccessLog())
+	mux.Use(tracing.Middleware(tracer))
+	mux.Use(metrics.HTTPMiddleware(metricsRegistry))
+	mux.Use(router.Recover(logger, nil))
 
 	// public endpoints
 	mux.HandleFunc("/health", health)
+	mux.Handle("/metrics", metricsRegistry, requireMetricsToken)
 	mux.Handle("/signup", handleSignUp)
 	mux.Handle("/auth", handleAuth)
+	mux.Handle("/invitations/", handleAcceptInvitation)
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		config := auth.OIDCConfig{
+			Issuer:       issuer,
+			ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  baseURL + "/auth/oidc/callback",
+			AllowSignUp:  os.Getenv("OIDC_ALLOW_SIGNUP") == "true",
+		}
+		provider, err := auth.NewOIDCProvider(ctx, config, &http.Client{Transport: tracing.Transport(tracer, nil), Timeout: envDuration("OIDC_TIMEOUT", 10*time.Second)})
+		if err != nil {
+			logger.Fatal("error loading OIDC provider", "error", err)
+		}
+		handleOIDC := auth.NewOIDCHandler(ctx, logger, provider, identityRepo, userRepo, passwords, sessions)
+		mux.Handle("/auth/oidc/login", handleOIDC)
+		mux.Handle("/auth/oidc/callback", handleOIDC)
+	}
+	mux.Handle("/verify-email", handleVerifyEmail)
+	mux.Handle("/verify-email/resend", handleVerifyEmail)
+	mux.Handle("/verify-email/change", handleVerifyEmail)
+	mux.Handle("/password-reset", handlePasswordReset)
+	mux.Handle("/password-reset/confirm", handlePasswordReset)
 
-	mux.Use(auth.AuthMiddleware())
 	// private endpoints
-	mux.Handle("/toggles", handleToggles)
-	mux.Handle("/toggles/", handleToggles)
+	private := mux.Group("", auth.AuthMiddleware(revocations, sessions, apiKeyRepo, orgRepo))
+	private.Handle("/auth/logout", handleLogout)
+	private.Handle("/apikeys", handleAPIKeys)
+	private.Handle("/apikeys/", handleAPIKeys)
+	private.Handle("/me", handleProfile)
+	private.Handle("/me/password", handleProfile)
+	private.Handle("/me/export", handleExport)
+	private.Handle("/me/sessions", handleSessions)
+	private.Handle("/me/sessions/", handleSessions)
+	private.Handle("/me/2fa", handleTwoFactor)
+	private.Handle("/me/2fa/confirm", handleTwoFactor)
+	private.Handle("/orgs", handleOrgs)
+	private.Handle("/orgs/members", handleMembers)
+	private.Handle("/orgs/members/", handleMembers)
+	private.Handle("/orgs/service-accounts", handleServiceAccounts)
+	private.Handle("/orgs/service-accounts/", handleServiceAccounts)
+	private.Handle("/orgs/audit", handleAudit, auth.RequireScope(auth.SCOPE_AUDIT_READ))
+	private.Handle("/orgs/environments", handleEnvironments)
+	private.Handle("/orgs/environments/", handleEnvironments)
+	private.Handle("/orgs/invitations", handleInvitations)
+	private.Handle("/orgs/invitations/", handleInvitations)
+	private.Mount("/toggles", handleToggles, auth.RequireScopes(auth.SCOPE_TOGGLES_READ, auth.SCOPE_TOGGLES_WRITE))
 
-	logger.Println("running server on port " + port)
-	err := http.ListenAndServe(":"+port, mux)
-	if err != nil {
-		logger.Fatal(err)
+	admin := private.Group("/admin", auth.RequireScope(auth.SCOPE_ADMIN))
+	admin.Handle("/revoke-sessions", handleRevokeSessions)
+	admin.Handle("/users/", handleExport)
+	admin.HandleFunc("/routes", func(w http.ResponseWriter, req *http.Request) {
+		util.JsonResponse(mux.Routes(), http.StatusOK, w)
+	})
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+	stop, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+	// other instances revoke tokens too
+	go revocations.Watch(stop, envDuration("REVOCATIONS_REFRESH_INTERVAL", 5*time.Second), logger)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("running server", "port", port)
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serverErr:
+		logger.Fatal("server stopped", "error", err)
+	case <-stop.Done():
+	}
+
+	shutdown(server, tracer, envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+}
+
+// shutdown stops accepting connections and waits for the requests in flight,
+// at most for timeout, before flushing the traces and closing the database.
+func shutdown(server *http.Server, tracer *tracing.Tracer, timeout time.Duration) {
+	logger.Info("shutting down", "timeout", timeout)
+	drain, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := server.Shutdown(drain); err != nil {
+		logger.Error("error draining connections", "error", err)
+	}
+	if err := tracer.Shutdown(drain); err != nil {
+		logger.Error("error flushing traces", "error", err)
+	}
+	if err := dbConnection.Close(); err != nil {
+		logger.Error("error closing database", "error", err)
 	}
+	logger.Info("server stopped")
 }
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+)
+
+// InstrumentConnector times the statements run through the connections of
+// connector, by operation and table, e.g. select and toggles. Queries are
+// timed until the first rows are returned, not until they're all read.
+func InstrumentConnector(connector driver.Connector, registry *Registry) driver.Connector {
+	queries := registry.Histogram(
+		"db_query_duration_seconds",
+		"Time to run database statements, by operation and table.",
+		DEFAULT_BUCKETS,
+		"operation", "table",
+	)
+	return instrumentedConnector{connector, queries}
+}
+
+type instrumentedConnector struct {
+	driver.Connector
+	queries *Histogram
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn, c.queries}, nil
+}
+
+// instrumentedConn implements the optional interfaces database/sql uses
+// when the driver does, so wrapping doesn't change how statements run.
+type instrumentedConn struct {
+	driver.Conn
+	queries *Histogram
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.observe(query, time.Now())
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.observe(query, time.Now())
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) observe(query string, start time.Time) {
+	operation, table := describeQuery(query)
+	c.queries.Observe(time.Since(start).Seconds(), operation, table)
+}
+
+// describeQuery finds the operation and the first table of the statement,
+// the repositories build them from constants so the tables are few.
+func describeQuery(query string) (string, string) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return "", ""
+	}
+	operation := words[0]
+	for i, word := range words[:len(words)-1] {
+		if word == "from" || word == "into" || (word == "update" && i == 0) {
+			return operation, strings.Trim(words[i+1], `;(),"`)
+		}
+	}
+	return operation, ""
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"myfeaturetoggles.com/toggles/router"
+)
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// HTTPMiddleware counts the requests and their latency by method, route
+// pattern and status. Patterns rather than paths keep ids out of the labels.
+func HTTPMiddleware(registry *Registry) router.Middleware {
+	requests := registry.Counter(
+		"http_requests_total",
+		"Requests served, by method, route and status.",
+		"method", "route", "status",
+	)
+	durations := registry.Histogram(
+		"http_request_duration_seconds",
+		"Time to serve requests, by method, route and status.",
+		DEFAULT_BUCKETS,
+		"method", "route", "status",
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := router.NewResponseRecorder(w)
+			req = router.CapturePattern(req)
+
+			next.ServeHTTP(recorder, req)
+
+			method := req.Method
+			if !knownMethods[method] {
+				method = "OTHER"
+			}
+			route := router.Pattern(req)
+			if route == "" {
+				route = "unmatched"
+			}
+			status := strconv.Itoa(recorder.Status())
+			requests.Inc(method, route, status)
+			durations.Observe(time.Since(start).Seconds(), method, route, status)
+		})
+	}
+}
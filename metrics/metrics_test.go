@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/router"
+)
+
+func scrape(registry *Registry) string {
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.Counter("toggles_total", "Toggles.", "org")
+	histogram := registry.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	counter.Inc(`a"b`)
+	counter.Add(2, `a"b`)
+	histogram.Observe(0.5, "/toggles")
+	histogram.Observe(2, "/toggles")
+
+	expected := `# HELP toggles_total Toggles.
+# TYPE toggles_total counter
+toggles_total{org="a\"b"} 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/toggles",le="0.1"} 0
+latency_seconds_bucket{route="/toggles",le="1"} 1
+latency_seconds_bucket{route="/toggles",le="+Inf"} 2
+latency_seconds_sum{route="/toggles"} 2.5
+latency_seconds_count{route="/toggles"} 2
+`
+	if body := scrape(registry); body != expected {
+		t.Fatalf("metrics should be\n%s\nbut are\n%s", expected, body)
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	registry := NewRegistry()
+	r := router.NewRouter()
+	r.Use(HTTPMiddleware(registry))
+	r.Delete("/toggles/{id}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/toggles/dark-mode", nil))
+
+	body := scrape(registry)
+	if !strings.Contains(body, `http_requests_total{method="DELETE",route="/toggles/{id}",status="404"} 1`) {
+		t.Fatalf("requests should be counted by route pattern, got\n%s", body)
+	}
+	if !strings.Contains(body, `http_request_duration_seconds_count{method="DELETE",route="/toggles/{id}",status="404"} 1`) {
+		t.Fatalf("requests should be timed, got\n%s", body)
+	}
+}
+
+func TestDescribeQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		operation string
+		table     string
+	}{
+		{"SELECT id, value FROM toggles WHERE org_id=$1;", "select", "toggles"},
+		{"INSERT INTO sessions (id, user_id) VALUES ($1, $2);", "insert", "sessions"},
+		{"UPDATE users SET display_name=$1 WHERE id=$2;", "update", "users"},
+		{"DELETE FROM api_keys WHERE id=$1;", "delete", "api_keys"},
+		{"BEGIN", "begin", ""},
+	}
+
+	for _, test := range tests {
+		operation, table := describeQuery(test.query)
+		if operation != test.operation || table != test.table {
+			t.Fatalf("%q should be %s on %s, got %s on %s", test.query, test.operation, test.table, operation, table)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+// Formats of the access log, ACCESS_LOG_JSON goes through the structured
+// logger, the others are the Common and Combined Log Formats of web servers.
+const (
+	ACCESS_LOG_JSON     = "json"
+	ACCESS_LOG_COMMON   = "common"
+	ACCESS_LOG_COMBINED = "combined"
+)
+
+// AccessLog logs every request once it's served, with its route, status,
+// size, duration and the fields the handlers added with
+// logging.AddRequestFields.
+func AccessLog(logger *logging.Logger) Middleware {
+	return accessLog(func(req *http.Request, entry accessLogEntry) {
+		fields := []any{
+			"method", req.Method,
+			"route", loggedPath(req),
+			"status", entry.status,
+			"bytes", entry.bytes,
+			"duration_ms", float64(entry.duration.Microseconds()) / 1000,
+		}
+		fields = append(fields, logging.RequestFields(req.Context())...)
+		util.RequestLogger(logger, req).Info("request", fields...)
+	})
+}
+
+// FormattedAccessLog writes one line per request to w in the Common or
+// Combined Log Format, for tools expecting the logs of a web server. The
+// request line has the route instead of the requested URI.
+func FormattedAccessLog(w io.Writer, format string) (Middleware, error) {
+	if format != ACCESS_LOG_COMMON && format != ACCESS_LOG_COMBINED {
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	var mu sync.Mutex
+	return accessLog(func(req *http.Request, entry accessLogEntry) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		user := "-"
+		fields := logging.RequestFields(req.Context())
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "user_id" {
+				user = fmt.Sprint(fields[i+1])
+			}
+		}
+		size := "-"
+		if entry.bytes > 0 {
+			size = strconv.FormatInt(entry.bytes, 10)
+		}
+
+		line := fmt.Sprintf(
+			"%s - %s [%s] %s %d %s",
+			host,
+			user,
+			entry.start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(req.Method+" "+loggedPath(req)+" "+req.Proto),
+			entry.status,
+			size,
+		)
+		if format == ACCESS_LOG_COMBINED {
+			line += fmt.Sprintf(" %s %s", quoteOrDash(req.Referer()), quoteOrDash(req.UserAgent()))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, line+"\n")
+	}), nil
+}
+
+// loggedPath is the pattern of the route that served the request, paths and
+// queries carry tokens like the ones of invitations or OIDC callbacks. Only
+// requests served outside of a Router log their path, without the query.
+func loggedPath(req *http.Request) string {
+	if pattern := Pattern(req); pattern != "" {
+		return pattern
+	}
+	return req.URL.Path
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+type accessLogEntry struct {
+	start    time.Time
+	duration time.Duration
+	status   int
+	bytes    int64
+}
+
+func accessLog(write func(req *http.Request, entry accessLogEntry)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := NewResponseRecorder(w)
+			req = CapturePattern(req.WithContext(logging.WithRequestFields(req.Context())))
+
+			next.ServeHTTP(recorder, req)
+
+			write(req, accessLogEntry{start, time.Since(start), recorder.Status(), recorder.Bytes()})
+		})
+	}
+}
+
+// ResponseRecorder remembers the status code and the size of the body
+// written by the handler, for middlewares reporting on responses.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps responses flushable through the recorder.
+func (r *ResponseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status is 200 when the handler wrote nothing.
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *ResponseRecorder) Bytes() int64 {
+	return r.bytes
+}
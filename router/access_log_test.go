@@ -0,0 +1,91 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+func TestAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+	r := NewRouter()
+	r.Use(RequestID)
+	r.Use(AccessLog(logging.New(&logs, logging.INFO)))
+	r.HandleFunc("/toggles", func(w http.ResponseWriter, req *http.Request) {
+		logging.AddRequestFields(req.Context(), "user_id", 10)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	request := httptest.NewRequest("PUT", "/toggles", nil)
+	request.Header.Set("X-Request-ID", "abc")
+
+	r.ServeHTTP(httptest.NewRecorder(), request)
+
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatal("access log should be a JSON line", err)
+	}
+	expected := map[string]any{"method": "PUT", "route": "/toggles", "status": float64(201), "bytes": float64(7), "user_id": float64(10), "request_id": "abc"}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Fatalf("%s should be %v but is %v", key, value, line[key])
+		}
+	}
+	if _, ok := line["duration_ms"]; !ok {
+		t.Fatal("access log should have the duration")
+	}
+}
+
+func TestFormattedAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+	middleware, err := FormattedAccessLog(&logs, ACCESS_LOG_COMBINED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	r.Use(middleware)
+	r.HandleFunc("/toggles", func(w http.ResponseWriter, req *http.Request) {
+		logging.AddRequestFields(req.Context(), "user_id", 10)
+		w.Write([]byte("[]"))
+	})
+	request := httptest.NewRequest("GET", "/toggles?org=1", nil)
+	request.Header.Set("User-Agent", "curl/8.0")
+
+	r.ServeHTTP(httptest.NewRecorder(), request)
+
+	expected := regexp.MustCompile(`^192\.0\.2\.1 - 10 \[[^\]]+\] "GET /toggles HTTP/1\.1" 200 2 "-" "curl/8\.0"\n$`)
+	if !expected.Match(logs.Bytes()) {
+		t.Fatalf("line should be in the Combined Log Format, got %q", logs.String())
+	}
+	if _, err := FormattedAccessLog(&logs, "apache"); err == nil {
+		t.Fatal("unknown formats should be rejected")
+	}
+}
+
+func TestAccessLogsLeaveTokensOut(t *testing.T) {
+	var logs, lines bytes.Buffer
+	formatted, _ := FormattedAccessLog(&lines, ACCESS_LOG_COMMON)
+	r := NewRouter()
+	r.Use(AccessLog(logging.New(&logs, logging.INFO)))
+	r.Use(formatted)
+	r.Handle("/invitations/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	r.Handle("/auth/oidc/callback", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/invitations/secret-token/accept", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth/oidc/callback?code=secret-code&state=xyz", nil))
+
+	for _, output := range []string{logs.String(), lines.String()} {
+		if strings.Contains(output, "secret") || strings.Contains(output, "xyz") {
+			t.Fatalf("access logs shouldn't have tokens, got %q", output)
+		}
+		if !strings.Contains(output, "/invitations/") || !strings.Contains(output, "/auth/oidc/callback") {
+			t.Fatalf("access logs should have the routes, got %q", output)
+		}
+	}
+}
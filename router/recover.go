@@ -0,0 +1,62 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/util"
+)
+
+// ErrorReporter receives the panics recovered while serving requests, e.g.
+// to forward them to an error tracking service.
+type ErrorReporter interface {
+	Report(req *http.Request, err error, stack []byte)
+}
+
+// ReporterFunc adapts a function to ErrorReporter.
+type ReporterFunc func(req *http.Request, err error, stack []byte)
+
+func (f ReporterFunc) Report(req *http.Request, err error, stack []byte) {
+	f(req, err, stack)
+}
+
+// Recover turns a panic in the handlers behind it into a JSON 500, logging
+// the stack and passing the panic to the reporter, which may be nil.
+// http.ErrAbortHandler is let through, it's how handlers abort on purpose.
+func Recover(logger *logging.Logger, reporter ErrorReporter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				err, ok := recovered.(error)
+				if !ok {
+					err = errors.New(fmt.Sprint(recovered))
+				}
+				stack := debug.Stack()
+				util.RequestLogger(logger, req).Error(
+					"panic serving request",
+					"method", req.Method,
+					"route", loggedPath(req),
+					"error", err,
+					"stack", string(stack),
+				)
+				if reporter != nil {
+					reporter.Report(req, err, stack)
+				}
+				util.JsonError("Internal server error", http.StatusInternalServerError, w)
+			}()
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
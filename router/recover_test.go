@@ -0,0 +1,43 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+	var reported error
+	reporter := ReporterFunc(func(req *http.Request, err error, stack []byte) {
+		reported = err
+	})
+	r := NewRouter()
+	r.Use(RequestID)
+	r.Use(Recover(logging.New(&logs, logging.INFO), reporter))
+	r.HandleFunc("/toggles", func(w http.ResponseWriter, req *http.Request) {
+		panic("nil map")
+	})
+	request := httptest.NewRequest("GET", "/toggles", nil)
+	request.Header.Set("X-Request-ID", "abc")
+	recorder := httptest.NewRecorder()
+
+	r.ServeHTTP(recorder, request)
+
+	var body map[string]string
+	json.NewDecoder(recorder.Body).Decode(&body)
+	if recorder.Code != http.StatusInternalServerError || body["error"] != "Internal server error" {
+		t.Fatalf("panic should be a JSON 500, got %d %v", recorder.Code, body)
+	}
+	if reported == nil || reported.Error() != "nil map" {
+		t.Fatalf("panic should be reported, got %v", reported)
+	}
+	if !strings.Contains(logs.String(), `"request_id":"abc"`) || !strings.Contains(logs.String(), "recover_test.go") {
+		t.Fatalf("log should have the request id and the stack, got %s", logs.String())
+	}
+}
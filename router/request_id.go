@@ -0,0 +1,46 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/util"
+)
+
+const MAX_REQUEST_ID_LENGTH = 64
+
+// RequestID gives every request an id, the one sent by the client in
+// X-Request-ID when it's usable or a random one. The id is stored in the
+// request context, see util.RequestId, and echoed in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(util.REQUEST_ID_HEADER)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+
+		w.Header().Set(util.REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, req.WithContext(util.WithRequestId(req.Context(), id)))
+	})
+}
+
+// validRequestId keeps ids from clients short and free of characters that
+// could forge log lines.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
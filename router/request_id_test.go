@@ -0,0 +1,39 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/util"
+)
+
+func TestRequestID(t *testing.T) {
+	var id string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id = util.RequestId(req.Context())
+	}))
+	tests := []struct {
+		header string
+		kept   bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"abc\nrequest_id=forged", false},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/toggles", nil)
+		request.Header.Set(util.REQUEST_ID_HEADER, test.header)
+
+		handler.ServeHTTP(recorder, request)
+
+		if id == "" || recorder.Header().Get(util.REQUEST_ID_HEADER) != id {
+			t.Fatalf("request id should be in the context and the response, got %q", id)
+		}
+		if (id == test.header) != test.kept {
+			t.Fatalf("request id %q from the client should be kept: %v, got %q", test.header, test.kept, id)
+		}
+	}
+}
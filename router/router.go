@@ -1,53 +1,343 @@
 package router
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+
+	"myfeaturetoggles.com/toggles/util"
 )
 
+// Router dispatches requests to handlers wrapped by the middlewares of the
+// router when they were registered. Groups share the routes of their parent
+// and add their own prefix and middlewares.
 type Router struct {
 	mux         *http.ServeMux
 	middlewares []Middleware
+	routes      *routes
+	prefix      string
 }
 
 type Middleware func(next http.Handler) http.Handler
 
 func NewRouter() Router {
-	return Router{http.NewServeMux(), []Middleware{}}
+	return Router{http.NewServeMux(), []Middleware{}, &routes{}, ""}
+}
+
+// Group returns a router registering its paths under the prefix, behind the
+// middlewares of r followed by the given ones. Middlewares added later to
+// either of them don't affect the other.
+func (r *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	return &Router{r.mux, r.with(middlewares), r.routes, r.prefix + prefix}
+}
+
+// Mount serves the prefix and everything below it with the handler, usually
+// another router. The handler sees the full path of the request.
+func (r *Router) Mount(prefix string, handler http.Handler, middlewares ...Middleware) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	all := r.with(middlewares)
+	r.registerHandler(r.prefix+prefix, handler, all)
+	r.registerHandler(r.prefix+prefix+"/", handler, all)
+
+	sub, ok := handler.(Router)
+	if !ok {
+		r.routes.describe("", r.prefix+prefix+"/", all)
+		return
+	}
+	for _, info := range sub.Routes() {
+		info.Middlewares = append(middlewareNames(all), info.Middlewares...)
+		r.routes.info = append(r.routes.info, info)
+	}
 }
 
 func (r *Router) Use(middleware Middleware) {
 	r.middlewares = append(r.middlewares, middleware)
 }
 
+// ServeHTTP dispatches to the routes registered by method first, the paths
+// registered with Handle are served like http.ServeMux does.
 func (r Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.mux.ServeHTTP(w, req)
+	route, params := r.routes.match(req.URL.Path)
+	if route == nil {
+		r.mux.ServeHTTP(w, req)
+		return
+	}
+
+	handler, ok := route.handlers[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		handler, ok = route.handlers[http.MethodGet]
+	}
+	if !ok {
+		setPattern(req, route.pattern)
+		w.Header().Set("Allow", route.allow())
+		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+		return
+	}
+	if len(params) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// Handle registers the handler like http.ServeMux does, the middlewares only
+// apply to this path, inside the ones of the router.
+func (r *Router) Handle(path string, handler http.Handler, middlewares ...Middleware) {
+	all := r.with(middlewares)
+	r.registerHandler(r.prefix+path, handler, all)
+	r.routes.describe("", r.prefix+path, all)
+}
+
+func (r *Router) HandleFunc(p string, handler func(http.ResponseWriter, *http.Request), middlewares ...Middleware) {
+	r.Handle(p, http.HandlerFunc(handler), middlewares...)
 }
 
-func (r *Router) Handle(path string, handler http.Handler) {
-	r.registerHandler(path, handler)
+func (r *Router) Get(pattern string, handler http.Handler, middlewares ...Middleware) {
+	r.Method(http.MethodGet, pattern, handler, middlewares...)
 }
 
-func (r *Router) HandleFunc(p string, handler func(http.ResponseWriter, *http.Request)) {
-	r.registerHandler(p, http.HandlerFunc(handler))
+func (r *Router) Post(pattern string, handler http.Handler, middlewares ...Middleware) {
+	r.Method(http.MethodPost, pattern, handler, middlewares...)
 }
 
-func (r *Router) registerHandler(path string, handler http.Handler) {
-	middlewares := r.middlewares
-	r.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
-		h := resolveHandler(middlewares, handler)
-		h.ServeHTTP(w, req)
-	})
+func (r *Router) Put(pattern string, handler http.Handler, middlewares ...Middleware) {
+	r.Method(http.MethodPut, pattern, handler, middlewares...)
 }
 
+func (r *Router) Patch(pattern string, handler http.Handler, middlewares ...Middleware) {
+	r.Method(http.MethodPatch, pattern, handler, middlewares...)
+}
+
+func (r *Router) Delete(pattern string, handler http.Handler, middlewares ...Middleware) {
+	r.Method(http.MethodDelete, pattern, handler, middlewares...)
+}
+
+// Method registers the handler for the method on an exact path pattern,
+// segments like {id} match any non empty segment and are read with Param.
+// Requests to the pattern with other methods get a 405 listing the allowed
+// ones.
+func (r *Router) Method(method string, pattern string, handler http.Handler, middlewares ...Middleware) {
+	pattern = r.prefix + pattern
+	route := r.routes.get(pattern)
+	if _, ok := route.handlers[method]; ok {
+		panic(fmt.Sprintf("router: multiple registrations for %s %s", method, pattern))
+	}
+
+	middlewares = r.with(middlewares)
+	route.handlers[method] = resolveHandler(middlewares, patternHandler{pattern, handler})
+	r.routes.describe(method, pattern, middlewares)
+}
+
+// RouteInfo describes a registered route, Method is empty for the paths
+// registered with Handle which serve any method.
+type RouteInfo struct {
+	Method      string   `json:"method,omitempty"`
+	Pattern     string   `json:"pattern"`
+	Middlewares []string `json:"middlewares"`
+}
+
+// Routes lists the registered routes in registration order, with the
+// middlewares they run behind, outermost first. The routes of mounted
+// routers are included.
+func (r Router) Routes() []RouteInfo {
+	routes := make([]RouteInfo, len(r.routes.info))
+	copy(routes, r.routes.info)
+	return routes
+}
+
+// with returns the middlewares of the router followed by the given ones, in
+// a new slice so later calls to Use don't change it.
+func (r *Router) with(middlewares []Middleware) []Middleware {
+	all := make([]Middleware, 0, len(r.middlewares)+len(middlewares))
+	all = append(all, r.middlewares...)
+	return append(all, middlewares...)
+}
+
+func (r *Router) registerHandler(path string, handler http.Handler, middlewares []Middleware) {
+	r.mux.Handle(path, resolveHandler(middlewares, patternHandler{path, handler}))
+}
+
+// resolveHandler wraps the handler once at registration, so the first
+// middleware is the outermost one.
 func resolveHandler(middlewares []Middleware, h http.Handler) http.Handler {
-	switch len(middlewares) {
-	case 0:
-		return h
-	case 1:
-		return middlewares[0](h)
-	default:
-		head := middlewares[0]
-		tail := middlewares[1:]
-		return head(resolveHandler(tail, h))
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// middlewareNames names the middlewares after the functions that built them,
+// like auth.RequireScope.
+func middlewareNames(middlewares []Middleware) []string {
+	names := make([]string, len(middlewares))
+	for i, middleware := range middlewares {
+		name := runtime.FuncForPC(reflect.ValueOf(middleware).Pointer()).Name()
+		name = name[strings.LastIndex(name, "/")+1:]
+		for strings.Contains(name, ".func") {
+			name = name[:strings.LastIndex(name, ".func")]
+		}
+		names[i] = name
+	}
+	return names
+}
+
+type paramsKey struct{}
+
+type patternKey struct{}
+
+// matchedPattern is shared by the routers a request goes through, so
+// middlewares of the outer ones see the pattern of the innermost route.
+type matchedPattern struct {
+	pattern string
+}
+
+// patternHandler records the pattern the handler was registered with, inside
+// its middlewares, so requests nobody captures the pattern of cost nothing.
+type patternHandler struct {
+	pattern string
+	next    http.Handler
+}
+
+func (h patternHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setPattern(req, h.pattern)
+	h.next.ServeHTTP(w, req)
+}
+
+func setPattern(req *http.Request, pattern string) {
+	if matched, ok := req.Context().Value(patternKey{}).(*matchedPattern); ok {
+		matched.pattern = pattern
+	}
+}
+
+// CapturePattern returns the request Pattern reports the route of once it
+// was served, for middlewares labelling requests by route.
+func CapturePattern(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(patternKey{}).(*matchedPattern); ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), patternKey{}, &matchedPattern{}))
+}
+
+// Pattern returns the pattern of the route that served the request, e.g.
+// /toggles/{id}, or an empty string when none matched or the request didn't
+// go through CapturePattern. Middlewares read it once the handler returned,
+// when mounted routers had their say.
+func Pattern(req *http.Request) string {
+	matched, ok := req.Context().Value(patternKey{}).(*matchedPattern)
+	if !ok {
+		return ""
+	}
+	return matched.pattern
+}
+
+// Param returns the value of the {name} segment of the route that matched
+// the request, or an empty string.
+func Param(req *http.Request, name string) string {
+	params, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+type routes struct {
+	list []*route
+	info []RouteInfo
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	// literals ranks routes matching the same path, /toggles/new wins over
+	// /toggles/{id}.
+	literals int
+	handlers map[string]http.Handler
+}
+
+func (rs *routes) get(pattern string) *route {
+	for _, route := range rs.list {
+		if route.pattern == pattern {
+			return route
+		}
 	}
+
+	route := &route{pattern: pattern, segments: splitPath(pattern), handlers: map[string]http.Handler{}}
+	for _, segment := range route.segments {
+		if !isParam(segment) {
+			route.literals++
+		}
+	}
+	rs.list = append(rs.list, route)
+
+	return route
+}
+
+func (rs *routes) describe(method string, pattern string, middlewares []Middleware) {
+	rs.info = append(rs.info, RouteInfo{method, pattern, middlewareNames(middlewares)})
+}
+
+func (rs *routes) match(path string) (*route, map[string]string) {
+	segments := splitPath(path)
+	var best *route
+	var bestParams map[string]string
+	for _, route := range rs.list {
+		if best != nil && route.literals <= best.literals {
+			continue
+		}
+		if params, ok := route.match(segments); ok {
+			best = route
+			bestParams = params
+		}
+	}
+
+	return best, bestParams
+}
+
+func (r *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, segment := range r.segments {
+		if !isParam(segment) {
+			if segment != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+		if segments[i] == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+		params[segment[1:len(segment)-1]] = segments[i]
+	}
+
+	return params, true
+}
+
+// allow lists the methods of the route for the Allow header.
+func (r *route) allow() string {
+	methods := []string{}
+	for method := range r.handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := r.handlers[http.MethodGet]; ok {
+		if _, ok := r.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func isParam(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
 }
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func serve(r Router, method string, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func write(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+func TestParam(t *testing.T) {
+	r := NewRouter()
+	r.Get("/toggles/{id}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(Param(req, "id")))
+	}))
+
+	if recorder := serve(r, "GET", "/toggles/dark-mode"); recorder.Body.String() != "dark-mode" {
+		t.Fatalf("id should be dark-mode but is %q", recorder.Body.String())
+	}
+	if recorder := serve(r, "GET", "/toggles/"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("params shouldn't match empty segments, got %d", recorder.Code)
+	}
+	if recorder := serve(r, "GET", "/toggles/a/b"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("params shouldn't match several segments, got %d", recorder.Code)
+	}
+}
+
+func TestLiteralSegmentsWin(t *testing.T) {
+	r := NewRouter()
+	r.Get("/toggles/{id}", write("param"))
+	r.Get("/toggles/new", write("literal"))
+
+	if body := serve(r, "GET", "/toggles/new").Body.String(); body != "literal" {
+		t.Fatalf("literal route should be preferred, got %q", body)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := NewRouter()
+	r.Get("/toggles", write("list"))
+	r.Put("/toggles", write("put"))
+
+	recorder := serve(r, "DELETE", "/toggles")
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Status code should be 405 but is %d", recorder.Code)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD, PUT" {
+		t.Fatalf("Allow should list the registered methods but is %q", allow)
+	}
+	if recorder := serve(r, "HEAD", "/toggles"); recorder.Code != http.StatusOK {
+		t.Fatalf("HEAD should be served by GET, got %d", recorder.Code)
+	}
+}
+
+func TestMiddlewaresAndFallback(t *testing.T) {
+	r := NewRouter()
+	r.Handle("/health", write("ok"))
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Middleware", "yes")
+			next.ServeHTTP(w, req)
+		})
+	})
+	r.Get("/toggles", write("list"))
+
+	if recorder := serve(r, "GET", "/toggles"); recorder.Header().Get("X-Middleware") != "yes" {
+		t.Fatal("middleware registered before the route should run")
+	}
+	recorder := serve(r, "GET", "/health")
+	if recorder.Body.String() != "ok" || recorder.Header().Get("X-Middleware") != "" {
+		t.Fatal("paths registered with Handle should be served with their own middlewares")
+	}
+}
+
+func header(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add("X-Middleware", name)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func TestGroup(t *testing.T) {
+	r := NewRouter()
+	r.Use(header("root"))
+	admin := r.Group("/admin", header("admin"))
+	admin.Get("/users/{id}", write("user"), header("route"))
+	r.Use(header("late"))
+	r.Handle("/health", write("ok"))
+
+	recorder := serve(r, "GET", "/admin/users/1")
+
+	if recorder.Body.String() != "user" {
+		t.Fatalf("group routes should be registered under its prefix, got %d", recorder.Code)
+	}
+	if got := recorder.Header().Values("X-Middleware"); !reflect.DeepEqual(got, []string{"root", "admin", "route"}) {
+		t.Fatalf("middlewares should run from the router to the route, got %v", got)
+	}
+	if got := serve(r, "GET", "/health").Header().Values("X-Middleware"); !reflect.DeepEqual(got, []string{"root", "late"}) {
+		t.Fatalf("group middlewares shouldn't leak to the parent, got %v", got)
+	}
+}
+
+func TestMount(t *testing.T) {
+	sub := NewRouter()
+	sub.Get("/toggles", write("list"))
+	sub.Delete("/toggles/{id}", write("delete"))
+	r := NewRouter()
+	r.Mount("/toggles", sub, header("scopes"))
+
+	if recorder := serve(r, "GET", "/toggles"); recorder.Body.String() != "list" || recorder.Header().Get("X-Middleware") != "scopes" {
+		t.Fatal("mounted router should serve the prefix behind the middlewares")
+	}
+	if body := serve(r, "DELETE", "/toggles/dark-mode").Body.String(); body != "delete" {
+		t.Fatalf("mounted router should serve the paths below the prefix, got %q", body)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	sub := NewRouter()
+	sub.Get("/toggles", write("list"))
+	r := NewRouter()
+	r.Use(header("root"))
+	r.Handle("/health", write("ok"))
+	r.Group("/admin", header("admin")).Delete("/users/{id}", write("delete"))
+	r.Mount("/toggles", sub, header("scopes"))
+
+	expected := []RouteInfo{
+		{"", "/health", []string{"router.header"}},
+		{"DELETE", "/admin/users/{id}", []string{"router.header", "router.header"}},
+		{"GET", "/toggles", []string{"router.header", "router.header"}},
+	}
+	if routes := r.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("routes should be %v but are %v", expected, routes)
+	}
+}
+
+func TestPattern(t *testing.T) {
+	var patterns []string
+	capture := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req = CapturePattern(req)
+			next.ServeHTTP(w, req)
+			patterns = append(patterns, Pattern(req))
+		})
+	}
+	r := NewRouter()
+	r.Use(capture)
+	r.Handle("/apikeys", write("keys"))
+	sub := NewRouter()
+	sub.Get("/toggles/{id}", write("toggle"))
+	r.Mount("/toggles", sub)
+
+	serve(r, "GET", "/apikeys")
+	serve(r, "GET", "/toggles/dark-mode")
+	serve(r, "DELETE", "/toggles/dark-mode")
+
+	expected := []string{"/apikeys", "/toggles/{id}", "/toggles/{id}"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("patterns should be %v but are %v", expected, patterns)
+	}
+}
+
+func benchmarkRouter() Router {
+	r := NewRouter()
+	r.Use(header("one"))
+	r.Use(header("two"))
+	private := r.Group("", header("three"))
+	private.Handle("/apikeys", write("keys"))
+	private.Get("/toggles/{id}", write("toggle"))
+	return r
+}
+
+func BenchmarkHandle(b *testing.B) {
+	r := benchmarkRouter()
+	req := httptest.NewRequest("GET", "/apikeys", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkMethodWithParam(b *testing.B) {
+	r := benchmarkRouter()
+	req := httptest.NewRequest("GET", "/toggles/dark-mode", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
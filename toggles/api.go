@@ -3,89 +3,183 @@ package toggles
 import (
 	"context"
 	"encoding/json"
-	"log"
 	"net/http"
-	"strings"
+	"sort"
 
+	"myfeaturetoggles.com/toggles/audit"
 	"myfeaturetoggles.com/toggles/auth"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/metrics"
+	"myfeaturetoggles.com/toggles/router"
 	"myfeaturetoggles.com/toggles/util"
 )
 
 type toggleHandler struct {
-	ctx    context.Context
-	repo   ToggleRepo
-	logger *log.Logger
+	ctx          context.Context
+	repo         ToggleRepo
+	environments auth.EnvironmentRepository
+	recorder     audit.Recorder
+	evaluations  *metrics.Counter
+	logger       *logging.Logger
 }
 
 type Toggle struct {
-	Id    string `json:"id"`
-	Value string `json:"value"`
+	Id          string `json:"id"`
+	Value       string `json:"value"`
+	Environment string `json:"environment,omitempty"`
 }
 
-func NewHandler(ctx context.Context, repo ToggleRepo, logger *log.Logger) http.Handler {
-	return toggleHandler{ctx, repo, logger}
+// NewHandler serves GET and PUT /toggles and DELETE /toggles/{id}. Toggles
+// belong to the environment given by ?environment=, or the body on PUT, the
+// default one when empty. Changing them is subject to the restriction of the
+// environment. Every toggle served on GET, which is how clients evaluate
+// them, is counted in the registry.
+func NewHandler(
+	ctx context.Context,
+	repo ToggleRepo,
+	environments auth.EnvironmentRepository,
+	logger *logging.Logger,
+	recorder audit.Recorder,
+	registry *metrics.Registry,
+) http.Handler {
+	evaluations := registry.Counter(
+		"toggle_evaluations_total",
+		"Toggles served to clients, by toggle and the value they got.",
+		"toggle", "result",
+	)
+	h := toggleHandler{ctx, repo, environments, recorder, evaluations, logger}
+
+	r := router.NewRouter()
+	r.Get("/toggles", http.HandlerFunc(h.list))
+	r.Put("/toggles", http.HandlerFunc(h.put))
+	r.Delete("/toggles/{id}", http.HandlerFunc(h.remove))
+	// without an id, so the client is told what's missing
+	r.Delete("/toggles/", http.HandlerFunc(h.remove))
+
+	return r
 }
 
-func (h toggleHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (h toggleHandler) list(w http.ResponseWriter, req *http.Request) {
+	principal, err := auth.GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	environment, ok := queryEnvironment(w, req)
+	if !ok {
+		return
+	}
+	if !auth.AuthorizeReadEnvironment(w, req, environment) {
+		return
+	}
+	toggles, err := h.repo.GetAll(req.Context(), principal.OrgId, environment)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+
+	res := []Toggle{}
+	for k, v := range toggles {
+		res = append(res, Toggle{k, v, environment})
+		h.evaluations.Inc(k, v)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	util.JsonResponse(res, http.StatusOK, w)
+}
 
-	userId, err := auth.GetUserId(req)
+func (h toggleHandler) put(w http.ResponseWriter, req *http.Request) {
+	principal, err := auth.GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if !auth.Authorize(w, req, auth.ACTION_WRITE_TOGGLES) {
+		return
+	}
+	defer req.Body.Close()
+	var toggle Toggle
+	err = json.NewDecoder(req.Body).Decode(&toggle)
+	if err != nil || toggle.Id == "" || toggle.Value == "" {
+		util.JsonError("Both 'id' and 'value' are required", http.StatusBadRequest, w)
+		return
+	}
+	if !auth.IsValidEnvironment(toggle.Environment) {
+		util.JsonError(environmentError, http.StatusBadRequest, w)
+		return
+	}
+	if !auth.AuthorizeEnvironment(w, req, h.environments, toggle.Environment) {
+		return
+	}
+	err = h.repo.Add(req.Context(), toggle.Id, toggle.Value, toggle.Environment, principal.OrgId, principal.UserId)
 	if err != nil {
 		util.ErrorResponse(err, w)
 		return
 	}
-	switch req.Method {
-	case "GET":
-		toggles, err := h.repo.GetAll(h.ctx, userId)
-		if err != nil {
-			util.ErrorResponse(err, w)
-			return
-		}
-
-		res := []Toggle{}
-		for k, v := range toggles {
-			res = append(res, Toggle{k, v})
-		}
-		util.JsonResponse(res, http.StatusOK, w)
-	case "PUT":
-		defer req.Body.Close()
-		var toggle Toggle
-		err = json.NewDecoder(req.Body).Decode(&toggle)
-		if err != nil || toggle.Id == "" || toggle.Value == "" {
-			util.JsonError("Both 'id' and 'value' are required", http.StatusBadRequest, w)
-			return
-		}
-		err = h.repo.Add(h.ctx, toggle.Id, toggle.Value, userId)
-		if err != nil {
-			util.ErrorResponse(err, w)
-			return
-		}
-
-		w.WriteHeader(http.StatusCreated)
-	case "DELETE":
-		id := strings.Replace(req.URL.Path, "/toggles/", "", -1)
-
-		if len(id) == 0 || id == req.URL.Path {
-			util.JsonError("A valid id is required: /toggles/<id>", http.StatusBadRequest, w)
-			return
-		}
-
-		exist, err := h.repo.Exist(h.ctx, id, userId)
-		if err != nil {
-			util.ErrorResponse(err, w)
-			return
-		}
-		if !exist {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-
-		err = h.repo.Remove(h.ctx, id, userId)
-		if err != nil {
-			util.ErrorResponse(err, w)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-	default:
-		util.JsonError("Method not allowed", http.StatusMethodNotAllowed, w)
+	h.record(req, principal, "toggle.create", target(toggle.Id, toggle.Environment))
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h toggleHandler) remove(w http.ResponseWriter, req *http.Request) {
+	principal, err := auth.GetPrincipal(req)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	id := router.Param(req, "id")
+	if id == "" {
+		util.JsonError("A valid id is required: /toggles/<id>", http.StatusBadRequest, w)
+		return
+	}
+	environment, ok := queryEnvironment(w, req)
+	if !ok {
+		return
+	}
+	if !auth.AuthorizeEnvironment(w, req, h.environments, environment) {
+		return
+	}
+
+	exist, err := h.repo.Exist(req.Context(), id, environment, principal.OrgId)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = h.repo.Remove(req.Context(), id, environment, principal.OrgId)
+	if err != nil {
+		util.ErrorResponse(err, w)
+		return
+	}
+	h.record(req, principal, "toggle.delete", target(id, environment))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h toggleHandler) record(req *http.Request, principal auth.Principal, action string, target string) {
+	if err := h.recorder.Record(req.Context(), auth.AuditEvent(req, principal, action, target)); err != nil {
+		util.RequestLogger(h.logger, req).Error("error recording audit event", "error", err)
+	}
+}
+
+const environmentError = "'environment' must be up to 20 lowercase letters, digits, '-' or '_'"
+
+func queryEnvironment(w http.ResponseWriter, req *http.Request) (string, bool) {
+	environment := req.URL.Query().Get("environment")
+	if !auth.IsValidEnvironment(environment) {
+		util.JsonError(environmentError, http.StatusBadRequest, w)
+		return "", false
+	}
+	return environment, true
+}
+
+// target names the toggle in audit events, toggles of the default environment
+// keep the name they had before environments.
+func target(id string, environment string) string {
+	if environment == "" {
+		return "toggle:" + id
 	}
+	return "environment:" + environment + "/toggle:" + id
 }
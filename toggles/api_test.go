@@ -4,45 +4,95 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"myfeaturetoggles.com/toggles/audit"
+	"myfeaturetoggles.com/toggles/auth"
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/metrics"
 )
 
 const fakeJwt = "header.eyJVc2VySWQiOjEwLCJJYXQiOjE2NjI4NTQ2NzB9.sign"
 
+func withRole(request *http.Request, role string) *http.Request {
+	principal := auth.Principal{UserId: 10, OrgId: 1, Role: role}
+	return request.WithContext(auth.WithPrincipal(request.Context(), principal))
+}
+
 type FakeRepo struct {
 	Err         error
 	Entries     map[string]string
 	ToggleExist bool
 }
 
-func (r FakeRepo) GetAll(ctx context.Context, userId int64) (map[string]string, error) {
+func (r FakeRepo) GetAll(ctx context.Context, orgId int64, environment string) (map[string]string, error) {
 	return r.Entries, r.Err
 }
 
-func (r FakeRepo) Add(ctx context.Context, id string, value string, userId int64) error {
+func (r FakeRepo) Add(ctx context.Context, id string, value string, environment string, orgId int64, userId int64) error {
 	return r.Err
 }
 
-func (r FakeRepo) Remove(ctx context.Context, id string, userId int64) error {
+func (r FakeRepo) Remove(ctx context.Context, id string, environment string, orgId int64) error {
 	return r.Err
 }
 
-func (r FakeRepo) Exist(ctx context.Context, id string, userId int64) (bool, error) {
+func (r FakeRepo) Exist(ctx context.Context, id string, environment string, orgId int64) (bool, error) {
 	return r.ToggleExist, r.Err
 }
 
+func (r FakeRepo) ByAuthor(ctx context.Context, userId int64) ([]AuthoredToggle, error) {
+	return []AuthoredToggle{}, r.Err
+}
+
+// FakeEnvironments maps restricted environments to the role they require.
+type FakeEnvironments map[string]string
+
+func (e FakeEnvironments) GetAll(ctx context.Context, orgId int64) ([]auth.EnvironmentRestriction, error) {
+	restrictions := []auth.EnvironmentRestriction{}
+	for environment, role := range e {
+		restrictions = append(restrictions, auth.EnvironmentRestriction{Environment: environment, Role: role})
+	}
+	return restrictions, nil
+}
+
+func (e FakeEnvironments) RequiredRole(ctx context.Context, orgId int64, environment string) (string, error) {
+	return e[environment], nil
+}
+
+func (e FakeEnvironments) Restrict(ctx context.Context, orgId int64, environment string, role string) error {
+	e[environment] = role
+	return nil
+}
+
+func (e FakeEnvironments) Unrestrict(ctx context.Context, orgId int64, environment string) (bool, error) {
+	_, ok := e[environment]
+	delete(e, environment)
+	return ok, nil
+}
+
+type FakeRecorder struct {
+	Events []audit.Event
+}
+
+func (r *FakeRecorder) Record(ctx context.Context, event audit.Event) error {
+	r.Events = append(r.Events, event)
+	return nil
+}
+
 func TestGetTogglesSuccess(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	toggleList := map[string]string{"id1": "value1", "id2": "value2"}
 	request := httptest.NewRequest("GET", "/toggles", nil)
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	repo := FakeRepo{Entries: toggleList}
-	handler := NewHandler(context.Background(), repo, log.Default())
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	handler.ServeHTTP(recorder, request)
 
@@ -52,22 +102,45 @@ func TestGetTogglesSuccess(t *testing.T) {
 	var resBody []Toggle
 	json.NewDecoder(result.Body).Decode(&resBody)
 
-	expectedBody := []Toggle{{"id1", "value1"}, {"id2", "value2"}}
+	expectedBody := []Toggle{{"id1", "value1", ""}, {"id2", "value2", ""}}
 	if !reflect.DeepEqual(resBody, expectedBody) {
 		t.Error("Response body doen't match")
 	}
 }
 
+func TestGetTogglesCountsEvaluations(t *testing.T) {
+	registry := metrics.NewRegistry()
+	repo := FakeRepo{Entries: map[string]string{"id1": "value1", "id2": "value2"}}
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, registry)
+	for i := 0; i < 2; i++ {
+		request := withRole(httptest.NewRequest("GET", "/toggles", nil), auth.ROLE_EDITOR)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`toggle_evaluations_total{toggle="id1",result="value1"} 2`,
+		`toggle_evaluations_total{toggle="id2",result="value2"} 2`,
+	} {
+		if !strings.Contains(recorder.Body.String(), line) {
+			t.Errorf("metrics should contain %s, got:\n%s", line, recorder.Body.String())
+		}
+	}
+}
+
 func TestPutTogglesSuccess(t *testing.T) {
-	body := Toggle{"id", "value"}
+	body := Toggle{Id: "id", Value: "value"}
 	json, _ := json.Marshal(body)
 	request := httptest.NewRequest("PUT", "/toggles", bytes.NewBuffer(json))
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	recorder := httptest.NewRecorder()
 
 	repo := FakeRepo{Err: nil}
 
-	handler := NewHandler(context.Background(), repo, log.Default())
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	handler.ServeHTTP(recorder, request)
 
@@ -78,16 +151,17 @@ func TestPutTogglesSuccess(t *testing.T) {
 }
 
 func TestPutTogglesFail(t *testing.T) {
-	toggle := Toggle{"", "value"}
+	toggle := Toggle{Id: "", Value: "value"}
 	jsonBody, _ := json.Marshal(toggle)
 	request := httptest.NewRequest("PUT", "/toggles", bytes.NewBuffer(jsonBody))
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	recorder := httptest.NewRecorder()
 	defer request.Body.Close()
 
 	repo := FakeRepo{Err: nil}
 
-	h := NewHandler(context.Background(), repo, log.Default())
+	h := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	h.ServeHTTP(recorder, request)
 
@@ -111,10 +185,11 @@ func TestDeleteToggleSuccess(t *testing.T) {
 		nil,
 	)
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	recorder := httptest.NewRecorder()
 
 	repo := FakeRepo{Err: nil, ToggleExist: true}
-	handler := NewHandler(context.Background(), repo, log.Default())
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	handler.ServeHTTP(recorder, request)
 	result := recorder.Result()
@@ -132,10 +207,11 @@ func TestDeleteToggleFail(t *testing.T) {
 		nil,
 	)
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	recorder := httptest.NewRecorder()
 
 	repo := FakeRepo{Err: nil, ToggleExist: true}
-	handler := NewHandler(context.Background(), repo, log.Default())
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	handler.ServeHTTP(recorder, request)
 	result := recorder.Result()
@@ -161,10 +237,11 @@ func TestDeleteToggleFailWith404(t *testing.T) {
 		nil,
 	)
 	request.Header.Add("Authorization", fakeJwt)
+	request = withRole(request, auth.ROLE_EDITOR)
 	recorder := httptest.NewRecorder()
 
 	repo := FakeRepo{Err: nil, ToggleExist: false}
-	handler := NewHandler(context.Background(), repo, log.Default())
+	handler := NewHandler(context.Background(), repo, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
 
 	handler.ServeHTTP(recorder, request)
 	result := recorder.Result()
@@ -173,3 +250,106 @@ func TestDeleteToggleFailWith404(t *testing.T) {
 		t.Error("Status code should be 404")
 	}
 }
+
+func TestPutTogglesForbiddenForViewers(t *testing.T) {
+	body, _ := json.Marshal(Toggle{Id: "id", Value: "value"})
+	request := httptest.NewRequest("PUT", "/toggles", bytes.NewBuffer(body))
+	request = withRole(request, auth.ROLE_VIEWER)
+	recorder := httptest.NewRecorder()
+
+	handler := NewHandler(context.Background(), FakeRepo{}, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
+
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusForbidden {
+		t.Error("Status code should be 403")
+	}
+}
+
+func TestToggleChangesAreAudited(t *testing.T) {
+	jsonBody, _ := json.Marshal(Toggle{Id: "someId", Value: "on"})
+	request := httptest.NewRequest("PUT", "/toggles", bytes.NewBuffer(jsonBody))
+	principal := auth.Principal{UserId: 20, OrgId: 1, Role: auth.ROLE_EDITOR, KeyType: auth.SERVER_KEY, ServiceAccount: true}
+	request = request.WithContext(auth.WithPrincipal(request.Context(), principal))
+	audits := &FakeRecorder{}
+	handler := NewHandler(context.Background(), FakeRepo{}, FakeEnvironments{}, logging.Default(), audits, metrics.NewRegistry())
+
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if len(audits.Events) != 1 {
+		t.Fatal("toggle change should be audited")
+	}
+	event := audits.Events[0]
+	if event.ActorType != audit.ACTOR_SERVICE_ACCOUNT || event.ActorId != 20 || event.Target != "toggle:someId" {
+		t.Fatalf("service account should be the actor, got %+v", event)
+	}
+}
+
+func TestToggleMethodNotAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := withRole(httptest.NewRequest("DELETE", "/toggles", nil), auth.ROLE_EDITOR)
+	handler := NewHandler(context.Background(), FakeRepo{}, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
+
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Status code should be 405 but is %d", recorder.Code)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD, PUT" {
+		t.Fatalf("Allow header should be 'GET, HEAD, PUT' but is %q", allow)
+	}
+}
+
+func TestRestrictedEnvironment(t *testing.T) {
+	environments := FakeEnvironments{"production": auth.ROLE_ADMIN}
+	handler := NewHandler(context.Background(), FakeRepo{ToggleExist: true}, environments, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
+	put := func(role string, environment string) int {
+		body, _ := json.Marshal(Toggle{"id", "value", environment})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, withRole(httptest.NewRequest("PUT", "/toggles", bytes.NewBuffer(body)), role))
+		return recorder.Code
+	}
+
+	if code := put(auth.ROLE_EDITOR, "production"); code != http.StatusForbidden {
+		t.Fatalf("editors shouldn't change production, got %d", code)
+	}
+	if code := put(auth.ROLE_EDITOR, "staging"); code != http.StatusCreated {
+		t.Fatalf("editors should change unrestricted environments, got %d", code)
+	}
+	if code := put(auth.ROLE_ADMIN, "production"); code != http.StatusCreated {
+		t.Fatalf("admins should change production, got %d", code)
+	}
+	if code := put(auth.ROLE_ADMIN, "Prod!"); code != http.StatusBadRequest {
+		t.Fatalf("invalid environments should be rejected, got %d", code)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, withRole(httptest.NewRequest("DELETE", "/toggles/id?environment=production", nil), auth.ROLE_EDITOR))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("editors shouldn't remove toggles of production, got %d", recorder.Code)
+	}
+}
+
+func TestKeyRestrictedToEnvironment(t *testing.T) {
+	handler := NewHandler(context.Background(), FakeRepo{ToggleExist: true}, FakeEnvironments{}, logging.Default(), &FakeRecorder{}, metrics.NewRegistry())
+	serve := func(method string, path string, body string) int {
+		request := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		principal := auth.Principal{UserId: 10, OrgId: 1, Role: auth.ROLE_EDITOR, KeyType: auth.SERVER_KEY, Environment: "staging"}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request.WithContext(auth.WithPrincipal(request.Context(), principal)))
+		return recorder.Code
+	}
+
+	if code := serve("PUT", "/toggles", `{"id": "id", "value": "on", "environment": "staging"}`); code != http.StatusCreated {
+		t.Fatalf("the key should change its environment, got %d", code)
+	}
+	if code := serve("PUT", "/toggles", `{"id": "id", "value": "on", "environment": "production"}`); code != http.StatusForbidden {
+		t.Fatalf("the key shouldn't change other environments, got %d", code)
+	}
+	if code := serve("DELETE", "/toggles/id", ""); code != http.StatusForbidden {
+		t.Fatalf("the key shouldn't change the default environment, got %d", code)
+	}
+	if code := serve("GET", "/toggles?environment=production", ""); code != http.StatusForbidden {
+		t.Fatalf("the key shouldn't read other environments, got %d", code)
+	}
+}
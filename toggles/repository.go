@@ -4,15 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+
+	"myfeaturetoggles.com/toggles/tracing"
 )
 
 const TOGGLES_TABLE_NAME = "toggles"
 
 type ToggleRepo interface {
-	GetAll(ctx context.Context, userId int64) (map[string]string, error)
-	Add(ctx context.Context, id string, value string, userId int64) error
-	Remove(ctx context.Context, id string, userId int64) error
-	Exist(ctx context.Context, id string, userId int64) (bool, error)
+	GetAll(ctx context.Context, orgId int64, environment string) (map[string]string, error)
+	Add(ctx context.Context, id string, value string, environment string, orgId int64, userId int64) error
+	Remove(ctx context.Context, id string, environment string, orgId int64) error
+	Exist(ctx context.Context, id string, environment string, orgId int64) (bool, error)
+	// ByAuthor returns the toggles the user created in every organization.
+	ByAuthor(ctx context.Context, userId int64) ([]AuthoredToggle, error)
+}
+
+type AuthoredToggle struct {
+	Id          string `json:"id"`
+	Value       string `json:"value"`
+	Environment string `json:"environment,omitempty"`
+	OrgId       int64  `json:"org_id"`
 }
 
 type repo struct {
@@ -23,9 +34,12 @@ func NewRepo(dbConnection *sql.DB) ToggleRepo {
 	return repo{dbConnection}
 }
 
-func (r repo) GetAll(ctx context.Context, userId int64) (map[string]string, error) {
-	query := fmt.Sprintf("SELECT id, value FROM %s where user_id=$1;", TOGGLES_TABLE_NAME)
-	rows, err := r.dbConnection.QueryContext(ctx, query, userId)
+func (r repo) GetAll(ctx context.Context, orgId int64, environment string) (map[string]string, error) {
+	ctx, span := tracing.Start(ctx, "toggles.repo.GetAll")
+	defer span.Finish()
+
+	query := fmt.Sprintf("SELECT id, value FROM %s where org_id=$1 AND environment=$2;", TOGGLES_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query, orgId, environment)
 	if err != nil {
 		return map[string]string{}, err
 	}
@@ -39,16 +53,24 @@ func (r repo) GetAll(ctx context.Context, userId int64) (map[string]string, erro
 	return result, nil
 }
 
-func (r repo) Add(ctx context.Context, id string, value string, userId int64) error {
-	query := fmt.Sprintf("INSERT INTO %s (id, value, user_id) VALUES ($1, $2, $3);", TOGGLES_TABLE_NAME)
-	_, err := r.dbConnection.ExecContext(ctx, query, id, value, userId)
+// Add stores the toggle in the environment of the organization, userId is
+// kept as its author.
+func (r repo) Add(ctx context.Context, id string, value string, environment string, orgId int64, userId int64) error {
+	ctx, span := tracing.Start(ctx, "toggles.repo.Add")
+	defer span.Finish()
+
+	query := fmt.Sprintf("INSERT INTO %s (id, value, environment, org_id, user_id) VALUES ($1, $2, $3, $4, $5);", TOGGLES_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, id, value, environment, orgId, userId)
 
 	return err
 }
 
-func (r repo) Remove(ctx context.Context, id string, userId int64) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id=$1 AND user_id=$2;", TOGGLES_TABLE_NAME)
-	_, err := r.dbConnection.ExecContext(ctx, query, id, userId)
+func (r repo) Remove(ctx context.Context, id string, environment string, orgId int64) error {
+	ctx, span := tracing.Start(ctx, "toggles.repo.Remove")
+	defer span.Finish()
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id=$1 AND environment=$2 AND org_id=$3;", TOGGLES_TABLE_NAME)
+	_, err := r.dbConnection.ExecContext(ctx, query, id, environment, orgId)
 	if err != nil {
 		return err
 	}
@@ -56,9 +78,12 @@ func (r repo) Remove(ctx context.Context, id string, userId int64) error {
 	return nil
 }
 
-func (r repo) Exist(ctx context.Context, id string, userId int64) (bool, error) {
-	query := fmt.Sprintf("SELECT count(1) FROM %s WHERE id=$1 AND user_id=$2", TOGGLES_TABLE_NAME)
-	row := r.dbConnection.QueryRowContext(ctx, query, id, userId)
+func (r repo) Exist(ctx context.Context, id string, environment string, orgId int64) (bool, error) {
+	ctx, span := tracing.Start(ctx, "toggles.repo.Exist")
+	defer span.Finish()
+
+	query := fmt.Sprintf("SELECT count(1) FROM %s WHERE id=$1 AND environment=$2 AND org_id=$3", TOGGLES_TABLE_NAME)
+	row := r.dbConnection.QueryRowContext(ctx, query, id, environment, orgId)
 
 	var count int64
 	if err := row.Scan(&count); err != nil || count == 0 {
@@ -69,6 +94,29 @@ func (r repo) Exist(ctx context.Context, id string, userId int64) (bool, error)
 
 }
 
+func (r repo) ByAuthor(ctx context.Context, userId int64) ([]AuthoredToggle, error) {
+	ctx, span := tracing.Start(ctx, "toggles.repo.ByAuthor")
+	defer span.Finish()
+
+	query := fmt.Sprintf("SELECT id, value, environment, org_id FROM %s WHERE user_id=$1 ORDER BY org_id, environment, id;", TOGGLES_TABLE_NAME)
+	rows, err := r.dbConnection.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []AuthoredToggle{}
+	for rows.Next() {
+		var toggle AuthoredToggle
+		if err := rows.Scan(&toggle.Id, &toggle.Value, &toggle.Environment, &toggle.OrgId); err != nil {
+			return nil, err
+		}
+		result = append(result, toggle)
+	}
+
+	return result, rows.Err()
+}
+
 func mapRows(rows *sql.Rows, toMap map[string]string) error {
 	defer rows.Close()
 	for rows.Next() {
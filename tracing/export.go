@@ -0,0 +1,221 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	OTLP_BATCH_SIZE     = 100
+	OTLP_FLUSH_INTERVAL = 5 * time.Second
+	OTLP_QUEUE_SIZE     = 2048
+)
+
+// fileSpan is how FileExporter writes spans, one JSON object per line.
+type fileSpan struct {
+	TraceId    string         `json:"trace_id"`
+	SpanId     string         `json:"span_id"`
+	ParentId   string         `json:"parent_id,omitempty"`
+	Name       string         `json:"name"`
+	Kind       int            `json:"kind"`
+	Start      time.Time      `json:"start"`
+	DurationMs float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type fileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFileExporter writes the spans to w as JSON lines, for local
+// development and tests.
+func NewFileExporter(w io.Writer) Exporter {
+	return &fileExporter{w: w}
+}
+
+func (e *fileExporter) Export(span *Span) {
+	line := fileSpan{
+		TraceId:    span.TraceId.String(),
+		SpanId:     span.SpanId.String(),
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start.UTC(),
+		DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if span.ParentId != (SpanId{}) {
+		line.ParentId = span.ParentId.String()
+	}
+	encoded, _ := json.Marshal(line)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(encoded, '\n'))
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *Span
+	flush   chan chan struct{}
+	onError func(err error)
+}
+
+// NewOTLPExporter sends the spans in batches to an OpenTelemetry collector
+// with OTLP over HTTP and JSON, endpoint being like http://localhost:4318.
+// Spans are dropped when the collector can't keep up, errors are passed to
+// onError.
+func NewOTLPExporter(endpoint string, service string, client *http.Client, onError func(err error)) Exporter {
+	e := &otlpExporter{
+		url:     endpoint + "/v1/traces",
+		service: service,
+		client:  client,
+		spans:   make(chan *Span, OTLP_QUEUE_SIZE),
+		flush:   make(chan chan struct{}),
+		onError: onError,
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Shutdown sends the queued spans. The exporter can't be used afterwards.
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(OTLP_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	batch := []*Span{}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= OTLP_BATCH_SIZE {
+				e.send(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = []*Span{}
+			}
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			if len(batch) > 0 {
+				e.send(batch)
+			}
+			close(done)
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*Span) {
+	body, err := json.Marshal(otlpRequest(e.service, batch))
+	if err != nil {
+		e.onError(err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.onError(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.onError(fmt.Errorf("OTLP collector answered %s", resp.Status))
+	}
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the JSON encoding of
+// OTLP, where ids are hex and nanosecond timestamps are strings.
+func otlpRequest(service string, batch []*Span) map[string]any {
+	spans := []map[string]any{}
+	for _, span := range batch {
+		s := map[string]any{
+			"traceId":           span.TraceId.String(),
+			"spanId":            span.SpanId.String(),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+		if span.ParentId != (SpanId{}) {
+			s["parentSpanId"] = span.ParentId.String()
+		}
+		if span.Error != "" {
+			s["status"] = map[string]any{"code": 2, "message": span.Error}
+		}
+		spans = append(spans, s)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "myfeaturetoggles.com/toggles/tracing"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	list := []map[string]any{}
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, map[string]any{"key": key, "value": v})
+	}
+	return list
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/logging"
+	"myfeaturetoggles.com/toggles/router"
+)
+
+// Middleware traces every request in a server span, continuing the trace
+// of the caller given in the traceparent header. The trace id is added to
+// the access log.
+func Middleware(tracer *Tracer) router.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := req.Context()
+			var span *Span
+			if traceId, parentId, ok := ParseTraceparent(req.Header.Get("traceparent")); ok {
+				ctx, span = tracer.startRemote(ctx, req.Method, traceId, parentId)
+			} else {
+				ctx, span = tracer.Start(ctx, req.Method, KIND_SERVER)
+			}
+			if span == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			logging.AddRequestFields(ctx, "trace_id", span.TraceId.String())
+			recorder := router.NewResponseRecorder(w)
+			req = router.CapturePattern(req.WithContext(ctx))
+
+			next.ServeHTTP(recorder, req)
+
+			route := router.Pattern(req)
+			span.Name = req.Method + " " + route
+			span.SetAttribute("http.method", req.Method)
+			// the route only, paths and queries carry tokens
+			span.SetAttribute("http.route", route)
+			span.SetAttribute("http.status_code", recorder.Status())
+			if recorder.Status() >= 500 {
+				span.Error = http.StatusText(recorder.Status())
+			}
+			span.Finish()
+		})
+	}
+}
+
+// Transport traces the requests sent through base in client spans and
+// propagates the trace to the servers called.
+func Transport(tracer *Tracer, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return transport{tracer, base}
+}
+
+type transport struct {
+	tracer *Tracer
+	base   http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), req.Method+" "+req.URL.Host, KIND_CLIENT)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer span.Finish()
+
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	return resp, nil
+}
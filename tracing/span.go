@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceId [16]byte
+
+type SpanId [8]byte
+
+func (id TraceId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Kinds of span, numbered as in OTLP.
+const (
+	KIND_INTERNAL = 1
+	KIND_SERVER   = 2
+	KIND_CLIENT   = 3
+)
+
+// Span is a timed operation of a trace, started with Tracer.Start and
+// exported when it ends. Its methods do nothing on a nil span, which is
+// what a tracer without exporter starts.
+type Span struct {
+	TraceId    TraceId
+	SpanId     SpanId
+	ParentId   SpanId
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	// Error describes why the operation failed, empty when it didn't.
+	Error string
+
+	mu     sync.Mutex
+	tracer *Tracer
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.Export(s)
+}
+
+// Traceparent formats the span for the W3C traceparent header.
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceId, s.SpanId)
+}
+
+// ParseTraceparent reads the trace and parent span ids of a W3C traceparent
+// header, ok is false when it's missing or invalid.
+func ParseTraceparent(header string) (traceId TraceId, parentId SpanId, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceId, parentId, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceId, parentId, false
+	}
+	if _, err := hex.Decode(traceId[:], []byte(parts[1])); err != nil || traceId == (TraceId{}) {
+		return TraceId{}, SpanId{}, false
+	}
+	if _, err := hex.Decode(parentId[:], []byte(parts[2])); err != nil || parentId == (SpanId{}) {
+		return TraceId{}, SpanId{}, false
+	}
+	return traceId, parentId, true
+}
+
+type spanKey struct{}
+
+// FromContext returns the span the context is in, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Inject sets the traceparent header of an outgoing request to the span of
+// ctx, so the callee continues the trace.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set("traceparent", span.Traceparent())
+	}
+}
+
+func newIds() (TraceId, SpanId) {
+	var traceId TraceId
+	var spanId SpanId
+	rand.Read(traceId[:])
+	rand.Read(spanId[:])
+	return traceId, spanId
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"time"
+)
+
+// Exporter sends finished spans somewhere, it must not block the caller.
+type Exporter interface {
+	Export(span *Span)
+	// Shutdown exports what's pending, waiting at most until ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer exporting its spans, or tracing nothing when
+// exporter is nil.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter}
+}
+
+var defaultTracer = NewTracer(nil)
+
+// Default is the tracer of the repositories, which have no way to be given
+// one, set it once at startup.
+func Default() *Tracer {
+	return defaultTracer
+}
+
+func SetDefault(tracer *Tracer) {
+	defaultTracer = tracer
+}
+
+// Start is Default().Start with an internal span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return Default().Start(ctx, name, KIND_INTERNAL)
+}
+
+// Start begins a span, child of the span of ctx if any, and returns the
+// context to pass to the operations it covers.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t.exporter == nil {
+		return ctx, nil
+	}
+
+	traceId, spanId := newIds()
+	span := &Span{SpanId: spanId, TraceId: traceId, Name: name, Kind: kind, Start: time.Now(), Attributes: map[string]any{}, tracer: t}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentId = parent.SpanId
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startRemote begins a span continuing the trace of the caller.
+func (t *Tracer) startRemote(ctx context.Context, name string, traceId TraceId, parentId SpanId) (context.Context, *Span) {
+	ctx, span := t.Start(ctx, name, KIND_SERVER)
+	if span != nil {
+		span.TraceId = traceId
+		span.ParentId = parentId
+	}
+	return ctx, span
+}
+
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
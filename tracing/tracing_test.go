@@ -0,0 +1,143 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"myfeaturetoggles.com/toggles/router"
+)
+
+func readSpans(t *testing.T, out *bytes.Buffer) []fileSpan {
+	spans := []fileSpan{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var span fileSpan
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatal("spans should be JSON lines", err)
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, parentId, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceId.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || parentId.String() != "00f067aa0ba902b7" {
+		t.Fatalf("traceparent should be parsed, got %s %s %v", traceId, parentId, ok)
+	}
+
+	for _, header := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		if _, _, ok := ParseTraceparent(header); ok {
+			t.Fatalf("%q should be rejected", header)
+		}
+	}
+}
+
+func TestRequestSpans(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(NewFileExporter(&out))
+	SetDefault(tracer)
+	defer SetDefault(NewTracer(nil))
+
+	r := router.NewRouter()
+	r.Use(Middleware(tracer))
+	r.Get("/toggles", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := Start(req.Context(), "toggles.repo.GetAll")
+		span.Finish()
+	}))
+	request := httptest.NewRequest("GET", "/toggles?code=secret", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	r.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := readSpans(t, &out)
+	if len(spans) != 2 {
+		t.Fatalf("repository and request spans should be exported, got %d", len(spans))
+	}
+	repo, server := spans[0], spans[1]
+	if server.Name != "GET /toggles" || server.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentId != "00f067aa0ba902b7" {
+		t.Fatalf("request span should continue the caller's trace, got %+v", server)
+	}
+	if repo.TraceId != server.TraceId || repo.ParentId != server.SpanId {
+		t.Fatalf("repository span should be a child of the request span, got %+v", repo)
+	}
+	if server.Attributes["http.status_code"] != float64(200) || server.Attributes["http.route"] != "/toggles" {
+		t.Fatalf("request span should have the status and the route, got %v", server.Attributes)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Fatal("request span shouldn't have the query")
+	}
+}
+
+func TestTransportPropagates(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(NewFileExporter(&out))
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, parent := tracer.Start(context.Background(), "oidc login", KIND_INTERNAL)
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	client := &http.Client{Transport: Transport(tracer, nil)}
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	traceId, parentId, ok := ParseTraceparent(traceparent)
+	spans := readSpans(t, &out)
+	if !ok || traceId != parent.TraceId || len(spans) != 1 || parentId.String() != spans[0].SpanId {
+		t.Fatalf("callee should get the client span in traceparent, got %q", traceparent)
+	}
+}
+
+func TestDisabledTracer(t *testing.T) {
+	ctx, span := NewTracer(nil).Start(context.Background(), "noop", KIND_INTERNAL)
+	span.SetAttribute("key", "value")
+	span.Finish()
+
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatal("a tracer without exporter shouldn't trace")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]any
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer collector.Close()
+	exporter := NewOTLPExporter(collector.URL, "toggles", collector.Client(), func(err error) { t.Error(err) })
+	tracer := NewTracer(exporter)
+
+	_, span := tracer.Start(context.Background(), "GET /toggles", KIND_SERVER)
+	span.Finish()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resourceSpans := body["resourceSpans"].([]any)[0].(map[string]any)
+	spans := resourceSpans["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	if len(spans) != 1 || spans[0].(map[string]any)["traceId"] != span.TraceId.String() {
+		t.Fatalf("span should be sent to the collector, got %v", body)
+	}
+}
@@ -2,16 +2,23 @@ package util
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
+
+	"myfeaturetoggles.com/toggles/logging"
 )
 
 type ups struct {
 	Msg string `json:"error"`
 }
 
+// ErrorResponse logs the error with the request id the response is sent
+// with, if any, and replies with a 500.
 func ErrorResponse(err error, w http.ResponseWriter) {
-	log.Default().Println("Error: " + err.Error())
+	logger := logging.Default()
+	if id := w.Header().Get(REQUEST_ID_HEADER); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	logger.Error("request failed", "error", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+
+	"myfeaturetoggles.com/toggles/logging"
 )
 
 func TestJsonResponse(t *testing.T) {
@@ -43,7 +45,8 @@ func TestJsonResponse(t *testing.T) {
 
 func TestErrorResponse(t *testing.T) {
 	var logOutput bytes.Buffer
-	log.SetOutput(&logOutput)
+	logging.SetDefault(logging.New(&logOutput, logging.INFO))
+	defer logging.SetDefault(logging.New(os.Stderr, logging.INFO))
 
 	recorder := httptest.NewRecorder()
 
@@ -57,7 +60,7 @@ func TestErrorResponse(t *testing.T) {
 		t.Errorf("Body should be: '%v' but is '%v'", expectedSC, result.Status)
 	}
 
-	expectedLog := "Error: " + err.Error()
+	expectedLog := `"error":"` + err.Error() + `"`
 	actualLog := string(logOutput.Bytes())
 	if !strings.Contains(actualLog, expectedLog) {
 		t.Errorf("Body should be: '%v' but is '%v'", expectedLog, actualLog)
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"context"
+	"net/http"
+
+	"myfeaturetoggles.com/toggles/logging"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the id of the request the context belongs to, or an
+// empty string outside of a request.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// RequestLogger returns logger adding the id of the request to its lines, so
+// they can be correlated with the access log.
+func RequestLogger(logger *logging.Logger, req *http.Request) *logging.Logger {
+	id := RequestId(req.Context())
+	if id == "" {
+		return logger
+	}
+	return logger.With("request_id", id)
+}